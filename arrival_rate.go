@@ -0,0 +1,149 @@
+package workerclient
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// Executors a case can run with, selected by CaseBaseInfo.Executor.
+const (
+	ExecutorClosed      = "closed"       // a fixed number of VUs loop over the steps (default)
+	ExecutorArrivalRate = "arrival_rate" // iterations start at a target rate, whatever their latency
+)
+
+// ErrArrivalRateConcurrency is returned by SetConcurrency for an arrival-rate
+// case, whose VUs follow the rate up to ArrivalRate.MaxVUs.
+var ErrArrivalRateConcurrency = errors.New("arrival-rate case does not take a concurrency")
+
+// ArrivalRate configures the arrival-rate executor. Rate, and the stage
+// targets of a LoadProfile when the case has one, are iterations per second
+// across all workers; each worker starts its even part of them.
+type ArrivalRate struct {
+	Rate            float64 `json:"rate"`            // constant rate, used when the case has no LoadProfile
+	PreAllocatedVUs uint64  `json:"preAllocatedVUs"` // VUs each worker starts up front
+	MaxVUs          uint64  `json:"maxVUs"`          // VUs each worker may grow to, at least PreAllocatedVUs
+}
+
+// PoolSize returns the most VUs a worker may run.
+func (ar *ArrivalRate) PoolSize() uint64 {
+	if ar.MaxVUs < ar.PreAllocatedVUs {
+		return ar.PreAllocatedVUs
+	}
+	return ar.MaxVUs
+}
+
+func (cr *CaseRunner) isArrivalRate() bool {
+	return cr.Info.Executor == ExecutorArrivalRate && cr.Info.ArrivalRate != nil
+}
+
+// arrivalRate returns the iterations per second this worker starts elapsed
+// after the start, and false once the LoadProfile has ended.
+func (cr *CaseRunner) arrivalRate(elapsed time.Duration) (float64, bool) {
+	rate := cr.Info.ArrivalRate.Rate
+	if cr.hasLoadProfile() {
+		var ok bool
+		if rate, ok = cr.Info.LoadProfile.target(elapsed); !ok {
+			return 0, false
+		}
+	}
+	if cr.Info.WorkerTotal > 1 {
+		rate /= float64(cr.Info.WorkerTotal)
+	}
+	return rate * cr.rampDownLeft(), true
+}
+
+// runArrivalRate starts the pre-allocated VUs and then hands out iterations at
+// the arrival rate until the case is stopped. An iteration no VU is free for
+// starts a new VU while the pool is below its size, otherwise it is dropped.
+func (cr *CaseRunner) runArrivalRate(rql *RpsQLimiter, begin time.Time) {
+	for i := 0; i < int(cr.Info.ArrivalRate.PreAllocatedVUs); i++ {
+		if !cr.startArrivalVU(rql, false) {
+			break
+		}
+	}
+	cr.setState(CaseStateRunning)
+
+	// newRpsQLimiter has already checked the distribution.
+	sampler, _ := cr.newSampler(0)
+	last := time.Now()
+	// gap was drawn for gapRate, and is rescaled when the rate changes.
+	var gap time.Duration
+	gapRate := float64(0)
+	for cr.IsRunning() {
+		if cr.isPaused() {
+			cr.waitWhilePaused()
+			last = time.Now()
+			gapRate = 0
+			continue
+		}
+		rate, ok := cr.arrivalRate(cr.activeSince(begin))
+		if !ok {
+			go cr.Stop(StopReasonProfileComplete)
+			return
+		}
+		wait := loadProfileTick
+		if rate > 0 {
+			if gapRate == 0 {
+				gap = sampler.gap(rate)
+			} else if rate != gapRate {
+				gap = time.Duration(float64(gap) * gapRate / rate)
+			}
+			gapRate = rate
+			next := last.Add(gap)
+			now := time.Now()
+			if !next.After(now) {
+				cr.startIteration(rql)
+				last = next
+				gapRate = 0
+				// Do not burst to catch up after a stall.
+				if now.Sub(last) > maxArrivalLag {
+					last = now
+				}
+				continue
+			}
+			if d := next.Sub(now); d < wait {
+				wait = d
+			}
+		} else {
+			last = time.Now()
+			gapRate = 0
+		}
+		select {
+		case <-cr.stopCh:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// startIteration hands one iteration to an idle VU, or to a new one.
+func (cr *CaseRunner) startIteration(rql *RpsQLimiter) {
+	select {
+	case cr.arrivals <- struct{}{}:
+		return
+	default:
+	}
+	if !cr.startArrivalVU(rql, true) {
+		atomic.AddInt64(&cr.DroppedIterations, 1)
+	}
+}
+
+// startArrivalVU starts a VU at the lowest free executor index, and returns
+// false if the pool is full. With iterate the VU runs one iteration right away.
+func (cr *CaseRunner) startArrivalVU(rql *RpsQLimiter, iterate bool) bool {
+	cr.vuLock.Lock()
+	i := cr.nextFreeVULocked()
+	if i < 0 {
+		cr.vuLock.Unlock()
+		return false
+	}
+	cr.vuAlive[i] = true
+	atomic.StoreInt64(&cr.ActiveConcurrencyCount, int64(len(cr.vuAlive)))
+	cr.vuLock.Unlock()
+
+	cr.startVU(i, rql, func(gp, cp map[string]string, rql *RpsQLimiter, op *Output, _cr *CaseRunner) {
+		cr.TestCase.runArrivals(gp, cp, rql, op, _cr, iterate)
+	})
+	return true
+}
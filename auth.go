@@ -0,0 +1,227 @@
+package workerclient
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Headers carrying an HMAC request signature.
+const (
+	HeaderSignatureKeyId     = "X-Signature-Key-Id"
+	HeaderSignatureTimestamp = "X-Signature-Timestamp"
+	HeaderSignatureNonce     = "X-Signature-Nonce"
+	HeaderSignature          = "X-Signature"
+)
+
+var (
+	ErrMissingSignature = errors.New("missing request signature")
+	ErrSignatureExpired = errors.New("request signature timestamp out of range")
+	ErrNonceReused      = errors.New("request signature nonce already used")
+	ErrInvalidSignature = errors.New("invalid request signature")
+	ErrUnknownKeyId     = errors.New("unknown signature key id")
+)
+
+// Authenticator adds credentials to a coordinator request. body is the exact
+// request body that will be sent.
+type Authenticator interface {
+	Authenticate(req *http.Request, body []byte) error
+}
+
+// invalidator is implemented by authenticators that cache credentials and
+// must drop them when the coordinator answers 401.
+type invalidator interface {
+	Invalidate()
+}
+
+// BearerToken sends a static token in the Authorization header.
+type BearerToken string
+
+func (t BearerToken) Authenticate(req *http.Request, body []byte) error {
+	req.Header.Set("Authorization", "Bearer "+string(t))
+	return nil
+}
+
+// TokenRefresher sends a bearer token obtained from Refresh. The token is
+// cached until shortly before it expires or until the coordinator rejects it.
+type TokenRefresher struct {
+	Refresh     func() (token string, expiresAt time.Time, err error) // a zero expiresAt never expires
+	RefreshSkew time.Duration                                         // refresh this long before expiresAt
+	lock        sync.Mutex
+	token       string
+	expiresAt   time.Time
+}
+
+func (t *TokenRefresher) Token() (string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.token != "" && (t.expiresAt.IsZero() || time.Now().Add(t.RefreshSkew).Before(t.expiresAt)) {
+		return t.token, nil
+	}
+	token, expiresAt, err := t.Refresh()
+	if err != nil {
+		return "", fmt.Errorf("failed to refresh token: %w", err)
+	}
+	t.token, t.expiresAt = token, expiresAt
+	return token, nil
+}
+
+func (t *TokenRefresher) Authenticate(req *http.Request, body []byte) error {
+	token, err := t.Token()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// Invalidate drops the cached token so the next request refreshes it.
+func (t *TokenRefresher) Invalidate() {
+	t.lock.Lock()
+	t.token = ""
+	t.lock.Unlock()
+}
+
+// HMACSigner signs every request with HMAC-SHA256 over the method, host,
+// request URI with its query, timestamp, nonce and body hash. Coordinators
+// check it with VerifyHMACRequest.
+type HMACSigner struct {
+	KeyId  string
+	Secret []byte
+}
+
+func (s *HMACSigner) Authenticate(req *http.Request, body []byte) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	n := hex.EncodeToString(nonce)
+	req.Header.Set(HeaderSignatureKeyId, s.KeyId)
+	req.Header.Set(HeaderSignatureTimestamp, ts)
+	req.Header.Set(HeaderSignatureNonce, n)
+	req.Header.Set(HeaderSignature, SignRequest(s.Secret, req.Method, requestHost(req), req.URL.RequestURI(), ts, n, body))
+	return nil
+}
+
+// SignRequest returns the hex HMAC-SHA256 signature of a request. requestURI
+// is the path with its query string, as returned by url.URL.RequestURI.
+func SignRequest(secret []byte, method, host, requestURI, timestamp, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%v\n%v\n%v\n%v\n%v\n%x", method, host, requestURI, timestamp, nonce, bodyHash)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// requestHost returns the host a request is sent to, or was received on.
+func requestHost(req *http.Request) string {
+	if req.Host != "" {
+		return req.Host
+	}
+	return req.URL.Host
+}
+
+// MultiAuthenticator applies several authenticators in order, e.g. a bearer
+// token together with an HMAC signature.
+type MultiAuthenticator []Authenticator
+
+func (m MultiAuthenticator) Authenticate(req *http.Request, body []byte) error {
+	for _, a := range m {
+		if err := a.Authenticate(req, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m MultiAuthenticator) Invalidate() {
+	for _, a := range m {
+		if inv, ok := a.(invalidator); ok {
+			inv.Invalidate()
+		}
+	}
+}
+
+// NonceCache remembers nonces for TTL so VerifyHMACRequest can reject
+// replayed requests. TTL should be at least twice the allowed clock skew.
+type NonceCache struct {
+	TTL   time.Duration
+	lock  sync.Mutex
+	seen  map[string]time.Time
+	swept time.Time
+}
+
+func NewNonceCache(ttl time.Duration) *NonceCache {
+	return &NonceCache{
+		TTL:  ttl,
+		seen: map[string]time.Time{},
+	}
+}
+
+// Use records nonce and reports whether it had not been seen before.
+func (c *NonceCache) Use(nonce string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	if now.Sub(c.swept) > c.TTL {
+		for n, t := range c.seen {
+			if now.Sub(t) > c.TTL {
+				delete(c.seen, n)
+			}
+		}
+		c.swept = now
+	}
+	if t, ok := c.seen[nonce]; ok && now.Sub(t) <= c.TTL {
+		return false
+	}
+	c.seen[nonce] = now
+	return true
+}
+
+// VerifyHMACRequest checks a request signed by HMACSigner. secrets maps key
+// ids to secrets, maxSkew bounds the difference between the signature
+// timestamp and the local clock and nonces, if not nil, rejects replays. body
+// must be the full request body.
+func VerifyHMACRequest(req *http.Request, body []byte, secrets map[string][]byte, maxSkew time.Duration, nonces *NonceCache) error {
+	keyId := req.Header.Get(HeaderSignatureKeyId)
+	ts := req.Header.Get(HeaderSignatureTimestamp)
+	nonce := req.Header.Get(HeaderSignatureNonce)
+	sig := req.Header.Get(HeaderSignature)
+	if ts == "" || nonce == "" || sig == "" {
+		return ErrMissingSignature
+	}
+	secret, ok := secrets[keyId]
+	if !ok {
+		return ErrUnknownKeyId
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrSignatureExpired
+	}
+	skew := time.Since(time.Unix(unix, 0))
+	if skew > maxSkew || skew < -maxSkew {
+		return ErrSignatureExpired
+	}
+	expected := SignRequest(secret, req.Method, requestHost(req), req.URL.RequestURI(), ts, nonce, body)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(sig)) != 1 {
+		return ErrInvalidSignature
+	}
+	if nonces != nil && !nonces.Use(nonce) {
+		return ErrNonceReused
+	}
+	return nil
+}
+
+// VerifyBearerToken checks the Authorization header against token in
+// constant time.
+func VerifyBearerToken(req *http.Request, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte("Bearer "+token)) == 1
+}
@@ -0,0 +1,148 @@
+package workerclient
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var testSecrets = map[string][]byte{"k1": []byte("secret")}
+
+// signedRequest signs a worker request to url and returns it as the
+// coordinator receives it.
+func signedRequest(t *testing.T, url string, body []byte) *http.Request {
+	t.Helper()
+	out, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := &HMACSigner{KeyId: "k1", Secret: testSecrets["k1"]}
+	if err := signer.Authenticate(out, body); err != nil {
+		t.Fatal(err)
+	}
+	in := httptest.NewRequest("POST", url, bytes.NewReader(body))
+	in.Header = out.Header.Clone()
+	return in
+}
+
+// resign replaces the timestamp of req and signs it again with the right
+// secret, as a worker with a skewed clock would.
+func resign(req *http.Request, body []byte, ts time.Time) {
+	unix := strconv.FormatInt(ts.Unix(), 10)
+	req.Header.Set(HeaderSignatureTimestamp, unix)
+	req.Header.Set(HeaderSignature, SignRequest(testSecrets["k1"], req.Method, req.Host, req.URL.RequestURI(), unix, req.Header.Get(HeaderSignatureNonce), body))
+}
+
+func TestVerifyHMACRequest(t *testing.T) {
+	body := []byte(`{"baseInfo":{"name":"w1"}}`)
+	const url = "http://coordinator:8080/worker/push_status?worker=w1"
+	tests := []struct {
+		name   string
+		tamper func(req *http.Request) (*http.Request, []byte)
+		want   error
+	}{
+		{"valid", func(req *http.Request) (*http.Request, []byte) {
+			return req, body
+		}, nil},
+		{"body changed", func(req *http.Request) (*http.Request, []byte) {
+			return req, []byte(`{"baseInfo":{"name":"w2"}}`)
+		}, ErrInvalidSignature},
+		{"path changed", func(req *http.Request) (*http.Request, []byte) {
+			other := httptest.NewRequest("POST", "http://coordinator:8080/worker/send_step_metrics?worker=w1", nil)
+			other.Header = req.Header
+			return other, body
+		}, ErrInvalidSignature},
+		{"query changed", func(req *http.Request) (*http.Request, []byte) {
+			other := httptest.NewRequest("POST", "http://coordinator:8080/worker/push_status?worker=w2", nil)
+			other.Header = req.Header
+			return other, body
+		}, ErrInvalidSignature},
+		{"host changed", func(req *http.Request) (*http.Request, []byte) {
+			req.Host = "other:8080"
+			return req, body
+		}, ErrInvalidSignature},
+		{"method changed", func(req *http.Request) (*http.Request, []byte) {
+			req.Method = "PUT"
+			return req, body
+		}, ErrInvalidSignature},
+		{"signature changed", func(req *http.Request) (*http.Request, []byte) {
+			req.Header.Set(HeaderSignature, SignRequest([]byte("guess"), req.Method, req.Host, req.URL.RequestURI(), req.Header.Get(HeaderSignatureTimestamp), req.Header.Get(HeaderSignatureNonce), body))
+			return req, body
+		}, ErrInvalidSignature},
+		{"unknown key", func(req *http.Request) (*http.Request, []byte) {
+			req.Header.Set(HeaderSignatureKeyId, "k2")
+			return req, body
+		}, ErrUnknownKeyId},
+		{"missing nonce", func(req *http.Request) (*http.Request, []byte) {
+			req.Header.Del(HeaderSignatureNonce)
+			return req, body
+		}, ErrMissingSignature},
+		{"malformed timestamp", func(req *http.Request) (*http.Request, []byte) {
+			req.Header.Set(HeaderSignatureTimestamp, "yesterday")
+			return req, body
+		}, ErrSignatureExpired},
+		{"within skew", func(req *http.Request) (*http.Request, []byte) {
+			resign(req, body, time.Now().Add(-4*time.Minute))
+			return req, body
+		}, nil},
+		{"too old", func(req *http.Request) (*http.Request, []byte) {
+			resign(req, body, time.Now().Add(-6*time.Minute))
+			return req, body
+		}, ErrSignatureExpired},
+		{"too far ahead", func(req *http.Request) (*http.Request, []byte) {
+			resign(req, body, time.Now().Add(6*time.Minute))
+			return req, body
+		}, ErrSignatureExpired},
+	}
+	for _, tt := range tests {
+		req, got := tt.tamper(signedRequest(t, url, body))
+		err := VerifyHMACRequest(req, got, testSecrets, 5*time.Minute, NewNonceCache(10*time.Minute))
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%v: VerifyHMACRequest = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestVerifyHMACRequestNonceReuse(t *testing.T) {
+	body := []byte("{}")
+	nonces := NewNonceCache(10 * time.Minute)
+	req := signedRequest(t, "http://coordinator/worker/push_status", body)
+	if err := VerifyHMACRequest(req, body, testSecrets, 5*time.Minute, nonces); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyHMACRequest(req, body, testSecrets, 5*time.Minute, nonces); !errors.Is(err, ErrNonceReused) {
+		t.Fatalf("replay: VerifyHMACRequest = %v, want %v", err, ErrNonceReused)
+	}
+	// A forged request must not burn the nonce of the genuine one.
+	fresh := signedRequest(t, "http://coordinator/worker/push_status", body)
+	if err := VerifyHMACRequest(fresh, []byte("{ }"), testSecrets, 5*time.Minute, nonces); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatal(err)
+	}
+	if err := VerifyHMACRequest(fresh, body, testSecrets, 5*time.Minute, nonces); err != nil {
+		t.Fatalf("genuine request after a forgery: %v", err)
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	c := NewNonceCache(50 * time.Millisecond)
+	if !c.Use("a") || !c.Use("b") {
+		t.Fatal("fresh nonces rejected")
+	}
+	if c.Use("a") {
+		t.Fatal("reused nonce accepted")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !c.Use("a") {
+		t.Fatal("nonce still rejected after its TTL")
+	}
+	c.Use("c")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.seen["b"]; ok {
+		t.Fatal("expired nonce not swept")
+	}
+}
@@ -1,17 +1,60 @@
 package workerclient
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Narasimha1997/ratelimiter"
 	"github.com/caio/go-tdigest/v4"
-	"github.com/eapache/queue"
 )
 
+// DefaultDrainTimeout is how long StopRunChannel waits for VUs to finish
+// their current iteration before abandoning them.
+const DefaultDrainTimeout = 30 * time.Second
+
+// DefaultMetricsBufferSize is how many undelivered metric batches SendMetrics
+// keeps for retry before it starts dropping the oldest.
+const DefaultMetricsBufferSize = 100
+
+// Reasons a CaseRunner stopped, reported in TestCaseSummary.StopReason.
+const (
+	StopReasonDurationElapsed = "duration_elapsed"
+	StopReasonCoordinatorStop = "coordinator_stop"
+	StopReasonLocalAbort      = "local_abort"
+	StopReasonHeartbeatLost   = "heartbeat_lost"
+	StopReasonError           = "error"
+)
+
+// CaseRunner states, reported in TestCaseSummary.Status. A runner moves
+// idle -> preparing -> ramping -> running -> stopping -> idle, or ends in
+// error when it could not be prepared. A ramping or running case can be
+// paused.
+const (
+	CaseStateIdle      = "idle"
+	CaseStatePreparing = "preparing"
+	CaseStateRamping   = "ramping"
+	CaseStateRunning   = "running"
+	CaseStateStopping  = "stopping"
+	CaseStateError     = "error"
+	CaseStatePaused    = "paused"
+)
+
+var caseStateTransitions = map[string][]string{
+	CaseStateIdle:      {CaseStatePreparing, CaseStateStopping},
+	CaseStatePreparing: {CaseStateRamping, CaseStateStopping},
+	CaseStateRamping:   {CaseStateRunning, CaseStatePaused, CaseStateStopping},
+	CaseStateRunning:   {CaseStatePaused, CaseStateStopping},
+	CaseStatePaused:    {CaseStateRunning, CaseStateStopping},
+	CaseStateStopping:  {CaseStateIdle, CaseStateError},
+}
+
 type CaseRunnerInfo struct {
+	TaskId                    string
 	WorkerName                string
 	MaxConcurrencyInThisWoker uint64
 	RampingSeconds            uint64
@@ -19,37 +62,315 @@ type CaseRunnerInfo struct {
 	WorkerTotal               uint64
 	WorkerIndex               uint64
 	WorkerConcurrency         uint64
+	LoadProfile               *LoadProfile         // stage targets are totals across all workers
+	Executor                  string               // ExecutorClosed (default) or ExecutorArrivalRate
+	ArrivalRate               *ArrivalRate         // settings of ExecutorArrivalRate
+	ArrivalDistribution       *ArrivalDistribution // gaps between iterations and rate-limited steps
+	RampDownSeconds           uint64               // how long Stop takes to retire the VUs
+	MetricWindowSeconds       uint64               // length of the metrics windows; 0 and 60 keep minute windows with Ts in minutes
+	StartAt                   time.Time            // when ramping begins, on the worker clock; zero starts at once
 }
 
 type CaseRunner struct {
 	Info                   CaseRunnerInfo
 	TestCase               *TestCase
-	GlobalParams           map[string]string
-	IsRunning              bool
+	GlobalParams           map[string]string // params the case was started with, see CurrentGlobalParams
 	Output                 *Output
 	MetricsChan            chan ([]*CallTimeMetric)
 	ActiveConcurrencyCount int64
-	CoordinatorApi         string
-	httpClient             *HTTPClient
+	DrainTimeout           time.Duration
+	MetricsBackoff         Backoff
+	MetricsBufferSize      int
+	MetricsSpool           *MetricsSpool
+	DroppedIterations      int64  // arrival-rate iterations no VU was free for
+	CoordinatorApi         string // Deprecated: only used by runners built without a CoordinatorTransport
+	transport              CoordinatorTransport
+	stateLock              sync.Mutex
+	state                  string
+	stopReason             string        // guarded by stateLock
+	drainReport            *DrainReport  // guarded by stateLock
+	pauseLock              sync.Mutex    // keeps pause marks in the order of Pause and Resume
+	pausedFrom             string        // state to resume to
+	pausedAt               time.Time     // start of the current pause
+	pausedTotal            time.Duration // length of all earlier pauses
+	resumeCh               atomic.Value  // chan struct{}, closed unless paused
+	failed                 bool
+	vuWg                   sync.WaitGroup
+	vuStarted              int64
+	vuExited               int64
+	concurrencyCap         int64
+	targetConcurrency      int64
+	vuLock                 sync.Mutex
+	vuAlive                map[int]bool
+	scaleCh                chan struct{}
+	arrivals               chan struct{}
+	arrivalSeed            int64
+	clock                  *clockEstimator // offset to the coordinator clock, nil without a WorkerRunner
+	rampingDown            int32           // set once Stop has started the ramp-down
+	rampDownBegin          time.Time
+	rampDownFor            time.Duration
+	rpsLock                sync.Mutex
+	rpsQLimiter            *RpsQLimiter
+	rpsOverrides           map[string]uint64
+	paramsLock             sync.Mutex
+	globalParams           atomic.Value // *GlobalParamsSnapshot
+	notifyLock             sync.Mutex   // serializes OnGlobalParamsChanged
+	started                int32        // set by the first Run
+	stopOnce               sync.Once
+	haltOnce               sync.Once
+	running                int32 // 1 until the case is halted
+	stopCh                 chan struct{}
+	rampDone               chan struct{}
+	aggregatorDone         chan struct{}
+	sendDone               chan struct{}
+	drained                chan struct{}
 }
 
+// DrainReport describes how a CaseRunner stopped.
+type DrainReport struct {
+	CleanVUs       int64         // VUs that returned before the drain deadline
+	AbandonedVUs   int64         // VUs still in an iteration at the deadline
+	DroppedResults int64         // results sent by abandoned VUs after the output closed
+	Elapsed        time.Duration // time from stop request to last metrics batch delivered
+}
+
+// RpsQLimiter paces the steps of a case that have an RPS limit. Every Wait
+// reserves the next free slot of its step, so waiting VUs are released in
+// order and on time without a dispatcher goroutine.
 type RpsQLimiter struct {
-	Lock   sync.Mutex
-	Limter *ratelimiter.AttributeBasedLimiter
-	QMap   map[string]*queue.Queue
+	Lock  sync.Mutex
+	steps map[string]*stepLimit
+	// newSampler is set when the case has an ArrivalDistribution.
+	newSampler func(key string) (*arrivalSampler, error)
+}
+
+// stepLimit is the RPS limit of one step.
+type stepLimit struct {
+	rps     uint64
+	next    time.Time       // earliest release of the next reservation
+	sampler *arrivalSampler // nil spaces releases evenly
+	changed chan struct{}   // closed when the limit changes or is removed
+}
+
+// SetLimit changes the RPS limit of key. 0 removes the limit. VUs waiting for
+// key are released, or reserve again at the new limit.
+func (rql *RpsQLimiter) SetLimit(key string, rps uint64) {
+	rql.Lock.Lock()
+	defer rql.Lock.Unlock()
+	sl := rql.steps[key]
+	if sl != nil && sl.rps == rps {
+		return
+	}
+	if sl != nil {
+		close(sl.changed)
+	}
+	if rps == 0 {
+		delete(rql.steps, key)
+		return
+	}
+	if sl == nil {
+		sl = &stepLimit{}
+		if rql.newSampler != nil {
+			sl.sampler, _ = rql.newSampler(key)
+		}
+		rql.steps[key] = sl
+	}
+	sl.rps = rps
+	sl.next = time.Now()
+	sl.changed = make(chan struct{})
+}
+
+// limit returns the RPS limit of key, 0 if it has none.
+func (rql *RpsQLimiter) limit(key string) uint64 {
+	rql.Lock.Lock()
+	defer rql.Lock.Unlock()
+	if sl := rql.steps[key]; sl != nil {
+		return sl.rps
+	}
+	return 0
+}
+
+// Wait blocks until key may run once more or stop is closed, and returns how
+// long it waited. limited is false if key has no limit.
+func (rql *RpsQLimiter) Wait(key string, stop <-chan struct{}) (waited time.Duration, limited bool) {
+	begin := time.Now()
+	for {
+		rql.Lock.Lock()
+		sl := rql.steps[key]
+		if sl == nil {
+			rql.Lock.Unlock()
+			return time.Since(begin), limited
+		}
+		now := time.Now()
+		at := sl.next
+		if at.Before(now) {
+			at = now
+		}
+		sl.next = at.Add(sl.sampler.gap(float64(sl.rps)))
+		changed := sl.changed
+		rql.Lock.Unlock()
+		limited = true
+
+		d := at.Sub(now)
+		if d <= 0 {
+			return time.Since(begin), true
+		}
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+			return time.Since(begin), true
+		case <-stop:
+			timer.Stop()
+			return time.Since(begin), true
+		case <-changed:
+			timer.Stop()
+		}
+	}
+}
+
+// MetricRpsWait is the metric of how long VUs queued on the RPS limit of a
+// step, in milliseconds, apart from the step's own latency in step_call.
+const MetricRpsWait = "step_rps_wait"
+
+// limiterWait wraps the first result of a run of a rate-limited step, so the
+// wait travels through Output with it.
+type limiterWait struct {
+	IResultV1
+	step string
+	wait time.Duration
 }
 
 type Output struct {
 	ResChans chan IResultV1
+	lock     sync.RWMutex
+	closed   bool
+	dropped  int64
+}
+
+// Send delivers res to the aggregator. It returns false and drops res if the
+// output has already been closed.
+func (o *Output) Send(res IResultV1) bool {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	if o.closed {
+		atomic.AddInt64(&o.dropped, 1)
+		return false
+	}
+	o.ResChans <- res
+	return true
+}
+
+// Close closes ResChans once no Send is in progress.
+func (o *Output) Close() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if !o.closed {
+		o.closed = true
+		close(o.ResChans)
+	}
+}
+
+func NewCaseRunner(info CaseRunnerInfo, tc *TestCase, transport CoordinatorTransport) *CaseRunner {
+	seed := time.Now().UnixNano()
+	if info.ArrivalDistribution != nil && info.ArrivalDistribution.Seed != 0 {
+		seed = info.ArrivalDistribution.Seed
+	}
+	cr := &CaseRunner{
+		Info:      info,
+		TestCase:  tc,
+		running:   1,
+		transport: transport,
+		state:     CaseStateIdle,
+		Output: &Output{
+			ResChans: make(chan IResultV1, 1000),
+		},
+		MetricsChan:       make(chan ([]*CallTimeMetric), 1000),
+		DrainTimeout:      DefaultDrainTimeout,
+		MetricsBackoff:    DefaultMetricsBackoff(),
+		MetricsBufferSize: DefaultMetricsBufferSize,
+		concurrencyCap:    -1,
+		targetConcurrency: int64(info.MaxConcurrencyInThisWoker),
+		vuAlive:           map[int]bool{},
+		scaleCh:           make(chan struct{}, 1),
+		arrivals:          make(chan struct{}),
+		arrivalSeed:       seed,
+		rpsOverrides:      map[string]uint64{},
+		stopCh:            make(chan struct{}),
+		rampDone:          make(chan struct{}),
+		aggregatorDone:    make(chan struct{}),
+		sendDone:          make(chan struct{}),
+		drained:           make(chan struct{}),
+	}
+	resumed := make(chan struct{})
+	close(resumed)
+	cr.resumeCh.Store(resumed)
+	return cr
+}
+
+// IsRunning reports whether the VUs of the case may start new iterations. It
+// turns false once Stop has ramped down, or at once for a hard stop.
+func (cr *CaseRunner) IsRunning() bool {
+	return atomic.LoadInt32(&cr.running) == 1
+}
+
+// State returns the current CaseState* of the runner.
+func (cr *CaseRunner) State() string {
+	cr.stateLock.Lock()
+	defer cr.stateLock.Unlock()
+	return cr.state
+}
+
+// setState moves the runner to state and reports whether that transition is
+// allowed from the current state. A paused case stays paused until Resume,
+// which then moves it to state, e.g. when the ramp finished during the pause.
+func (cr *CaseRunner) setState(state string) bool {
+	cr.stateLock.Lock()
+	defer cr.stateLock.Unlock()
+	if !canTransition(cr.state, state) {
+		return false
+	}
+	if cr.state == CaseStatePaused && state != CaseStateStopping {
+		cr.pausedFrom = state
+		return true
+	}
+	cr.state = state
+	return true
+}
+
+// canTransition reports whether caseStateTransitions allows from -> to.
+func canTransition(from, to string) bool {
+	for _, next := range caseStateTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Done reports whether the runner has stopped and finished draining.
+func (cr *CaseRunner) Done() bool {
+	state := cr.State()
+	return state == CaseStateIdle && !cr.IsRunning() || state == CaseStateError
 }
 
 func (cr *CaseRunner) Run() {
-	cr.IsRunning = true
-	cr.ActiveConcurrencyCount = 0
-	cr.Output = &Output{
-		ResChans: make(chan IResultV1, 1000),
+	if !atomic.CompareAndSwapInt32(&cr.started, 0, 1) {
+		fmt.Printf("CaseRunner %v has already been started\n", cr.TestCase.Name)
+		return
+	}
+	scaling := false
+	defer func() {
+		if !scaling {
+			close(cr.rampDone)
+		}
+	}()
+	if !cr.setState(CaseStatePreparing) {
+		// Stopped before it started: nothing to run, let Stop finish.
+		fmt.Printf("CaseRunner %v cannot start from state %v\n", cr.TestCase.Name, cr.State())
+		close(cr.aggregatorDone)
+		close(cr.sendDone)
+		return
 	}
-	cr.MetricsChan = make(chan ([]*CallTimeMetric), 1000)
 	go func() {
 		cr.HandleOuput()
 	}()
@@ -58,43 +379,54 @@ func (cr *CaseRunner) Run() {
 		cr.SendMetrics()
 	}()
 
-	rpsQLimiter := &RpsQLimiter{
-		Lock:   sync.Mutex{},
-		Limter: ratelimiter.NewAttributeBasedLimiter(true),
-		QMap:   map[string]*queue.Queue{},
+	rpsQLimiter, err := cr.newRpsQLimiter()
+	if err == nil {
+		cr.rpsLock.Lock()
+		cr.rpsQLimiter = rpsQLimiter
+		cr.rpsLock.Unlock()
 	}
-	for _, ts := range cr.TestCase.Teststeps {
-		rps := ts.RpsLimitFunc(cr.Info, cr.GlobalParams)
-		if rps > 0 {
-			rpsQLimiter.Limter.CreateNewKey(ts.GetStepIndex(), rps, time.Second)
-			rpsQLimiter.QMap[ts.GetStepIndex()] = queue.New()
-		}
+	if err != nil {
+		fmt.Printf("CaseRunner %v failed to prepare: %v\n", cr.TestCase.Name, err)
+		cr.stateLock.Lock()
+		cr.failed = true
+		cr.stateLock.Unlock()
+		go cr.Stop(StopReasonError)
+		return
+	}
+	if ad := cr.Info.ArrivalDistribution; ad != nil {
+		fmt.Printf("CaseRunner %v paces arrivals with the %v distribution, seed %v\n", cr.TestCase.Name, ad.Type, cr.arrivalSeed)
+	}
+	if !cr.waitForStart() {
+		return
+	}
+	if cr.Info.DurationMinutes > 0 {
+		durationTimer := time.AfterFunc(time.Duration(cr.Info.DurationMinutes)*time.Minute, func() {
+			cr.Stop(StopReasonDurationElapsed)
+		})
+		go func() {
+			<-cr.stopCh
+			durationTimer.Stop()
+		}()
 	}
 
-	go func(rql *RpsQLimiter) {
-		for {
-			isHit := false
-			for k, v := range rql.QMap {
-				if v.Length() > 0 {
-					aw, _ := rql.Limter.ShouldAllow(k, 1)
-					if aw || !cr.IsRunning {
-						rql.Lock.Lock()
-						ch := (v.Remove()).(chan bool)
-						ch <- true
-						rql.Lock.Unlock()
-						isHit = true
-					}
-				}
-			}
-			if !isHit {
-				time.Sleep(time.Millisecond * 10)
-			}
-		}
-	}(rpsQLimiter)
-
+	cr.setState(CaseStateRamping)
+	begin := time.Now()
+	if cr.isArrivalRate() {
+		scaling = true
+		go func() {
+			defer close(cr.rampDone)
+			cr.runArrivalRate(rpsQLimiter, begin)
+		}()
+		return
+	}
+	// A load profile shapes the ramp itself, VUs start as soon as it asks.
+	if cr.hasLoadProfile() {
+		total, _ := cr.Info.LoadProfile.Target(0)
+		atomic.StoreInt64(&cr.targetConcurrency, int64(workerShare(total, cr.Info.WorkerConcurrency, int64(cr.Info.WorkerIndex))))
+	}
 	rampingLimit := uint64(10000)
 	rampingLimitDuration := time.Millisecond * 10
-	if cr.Info.RampingSeconds > 0 {
+	if cr.Info.RampingSeconds > 0 && !cr.hasLoadProfile() {
 		rampingLimitDuration = time.Second
 		rampingLimit = cr.Info.MaxConcurrencyInThisWoker / cr.Info.RampingSeconds
 		for {
@@ -106,76 +438,674 @@ func (cr *CaseRunner) Run() {
 		}
 	}
 	rampingLimiter := ratelimiter.NewDefaultLimiter(rampingLimit, rampingLimitDuration)
-	for i := 0; i < int(cr.Info.MaxConcurrencyInThisWoker); i++ {
+	if !cr.spawnVUs(rampingLimiter, rpsQLimiter) {
+		rampingLimiter.Kill()
+		return
+	}
+	cr.setState(CaseStateRunning)
+	if cr.hasLoadProfile() {
+		go cr.runLoadProfile(begin)
+	}
+
+	// SetConcurrency keeps using the ramp rate after the initial ramp.
+	scaling = true
+	go func() {
+		defer close(cr.rampDone)
+		defer rampingLimiter.Kill()
+		for {
+			select {
+			case <-cr.stopCh:
+				return
+			case <-cr.scaleCh:
+				cr.spawnVUs(rampingLimiter, rpsQLimiter)
+			}
+		}
+	}()
+}
+
+// spawnVUs starts a VU for every free executor index below the concurrency
+// target, no faster than rampingLimiter allows. It returns false if the case
+// was stopped meanwhile.
+func (cr *CaseRunner) spawnVUs(rampingLimiter *ratelimiter.DefaultLimiter, rql *RpsQLimiter) bool {
+	for {
+		if cr.nextFreeVU() < 0 {
+			return true
+		}
 		for {
 			allowed, _ := rampingLimiter.ShouldAllow(1)
-			if allowed || !cr.IsRunning {
+			if allowed || !cr.IsRunning() {
 				break
 			} else {
 				time.Sleep(time.Millisecond * 25)
 			}
 		}
+		if !cr.IsRunning() {
+			return false
+		}
 
-		if !cr.IsRunning {
-			return
+		cr.vuLock.Lock()
+		i := cr.nextFreeVULocked()
+		if i < 0 {
+			cr.vuLock.Unlock()
+			continue
+		}
+		cr.vuAlive[i] = true
+		atomic.StoreInt64(&cr.ActiveConcurrencyCount, int64(len(cr.vuAlive)))
+		cr.vuLock.Unlock()
+
+		cr.startVU(i, rql, cr.TestCase.Run)
+	}
+}
+
+// startVU runs a VU at executor index i, which the caller has marked alive.
+func (cr *CaseRunner) startVU(i int, rql *RpsQLimiter, run func(gp, cp map[string]string, rql *RpsQLimiter, op *Output, _cr *CaseRunner)) {
+	coroutineParams := map[string]string{
+		InnerVarGoroutineId:       fmt.Sprintf("%v-%v", cr.TestCase.Name, i),
+		InnerVarExecutorIndex:     fmt.Sprintf("%v", i),
+		InnerVarWorkerTotal:       fmt.Sprintf("%v", cr.Info.WorkerTotal),
+		InnerVarWorkerIndex:       fmt.Sprintf("%v", cr.Info.WorkerIndex),
+		InnerVarWorkerConcurrency: fmt.Sprintf("%v", cr.Info.WorkerConcurrency),
+		InnerVarTaskId:            cr.Info.TaskId,
+	}
+	cr.vuWg.Add(1)
+	atomic.AddInt64(&cr.vuStarted, 1)
+	go func(gp, cp map[string]string, rql *RpsQLimiter, op *Output, _cr *CaseRunner) {
+		defer cr.vuWg.Done()
+		defer atomic.AddInt64(&cr.vuExited, 1)
+		defer cr.releaseVU(i)
+		run(gp, cp, rql, op, _cr)
+	}(cr.currentParams(), coroutineParams, rql, cr.Output, cr)
+}
+
+func (cr *CaseRunner) nextFreeVU() int {
+	cr.vuLock.Lock()
+	defer cr.vuLock.Unlock()
+	return cr.nextFreeVULocked()
+}
+
+// nextFreeVULocked returns the lowest executor index below the target without
+// a VU, or -1. The caller must hold cr.vuLock.
+func (cr *CaseRunner) nextFreeVULocked() int {
+	target := int(atomic.LoadInt64(&cr.targetConcurrency))
+	for i := 0; i < target; i++ {
+		if !cr.vuAlive[i] {
+			return i
+		}
+	}
+	return -1
+}
+
+// SetConcurrency changes the number of VUs of a running case. New VUs start at
+// the ramp rate of the case; VUs above n finish their current iteration, run
+// TearDown and exit. An arrival-rate case sizes its VUs itself and returns
+// ErrArrivalRateConcurrency.
+func (cr *CaseRunner) SetConcurrency(n uint64) error {
+	if cr.isArrivalRate() {
+		return ErrArrivalRateConcurrency
+	}
+	if cr.isRampingDown() {
+		return nil
+	}
+	atomic.StoreInt64(&cr.targetConcurrency, int64(n))
+	select {
+	case cr.scaleCh <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Concurrency returns the number of VUs the case is scaled to.
+func (cr *CaseRunner) Concurrency() uint64 {
+	return uint64(atomic.LoadInt64(&cr.targetConcurrency))
+}
+
+// retireVU reports whether the VU at executorIndex is above the concurrency
+// target and must exit. Its executor index stays taken until the VU has run
+// TearDown, see releaseVU.
+func (cr *CaseRunner) retireVU(executorIndex int) bool {
+	return int64(executorIndex) >= atomic.LoadInt64(&cr.targetConcurrency)
+}
+
+// releaseVU frees the executor index of a VU that has exited, for whatever
+// reason. If the target has grown back over the index meanwhile, the scaler
+// is woken up to start a new VU there.
+func (cr *CaseRunner) releaseVU(executorIndex int) {
+	cr.vuLock.Lock()
+	delete(cr.vuAlive, executorIndex)
+	atomic.StoreInt64(&cr.ActiveConcurrencyCount, int64(len(cr.vuAlive)))
+	cr.vuLock.Unlock()
+	if cr.IsRunning() && int64(executorIndex) < atomic.LoadInt64(&cr.targetConcurrency) {
+		select {
+		case cr.scaleCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// newRpsQLimiter creates a limiter key for every step with an RPS limit.
+func (cr *CaseRunner) newRpsQLimiter() (*RpsQLimiter, error) {
+	rql := &RpsQLimiter{
+		Lock:  sync.Mutex{},
+		steps: map[string]*stepLimit{},
+	}
+	if cr.Info.ArrivalDistribution != nil {
+		if _, err := cr.newSampler(0); err != nil {
+			return nil, err
+		}
+		rql.newSampler = cr.newStepSampler
+	}
+	if err := cr.applyRpsLimits(rql); err != nil {
+		return nil, err
+	}
+	return rql, nil
+}
+
+// applyRpsLimits sets the limit of every step to its override, or else to
+// what RpsLimitFunc returns for the current GlobalParams. All limits are
+// computed before any is set, so a panicking RpsLimitFunc changes nothing and
+// is reported as an error.
+func (cr *CaseRunner) applyRpsLimits(rql *RpsQLimiter) error {
+	limits, err := cr.rpsLimits()
+	if err != nil {
+		return err
+	}
+	for i, ts := range cr.TestCase.Teststeps {
+		rql.SetLimit(ts.GetStepIndex(), limits[i])
+	}
+	return nil
+}
+
+// rpsLimits returns the limit of every step, in step order.
+func (cr *CaseRunner) rpsLimits() (limits []uint64, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("RpsLimitFunc panicked: %v", p)
+		}
+	}()
+	params := cr.currentParams()
+	cr.rpsLock.Lock()
+	overrides := make(map[string]uint64, len(cr.rpsOverrides))
+	for k, v := range cr.rpsOverrides {
+		overrides[k] = v
+	}
+	cr.rpsLock.Unlock()
+	for _, ts := range cr.TestCase.Teststeps {
+		rps, ok := overrides[ts.GetStepIndex()]
+		if !ok {
+			rps = ts.RpsLimitFunc(cr.Info, params)
+		}
+		limits = append(limits, rps)
+	}
+	return limits, nil
+}
+
+// refreshRpsLimits re-applies the step limits of a running case.
+func (cr *CaseRunner) refreshRpsLimits() error {
+	cr.rpsLock.Lock()
+	rql := cr.rpsQLimiter
+	cr.rpsLock.Unlock()
+	if rql == nil {
+		return nil
+	}
+	return cr.applyRpsLimits(rql)
+}
+
+func (cr *CaseRunner) stepByName(stepName string) (*TestStep, error) {
+	for _, ts := range cr.TestCase.Teststeps {
+		if ts.StepName == stepName {
+			return ts, nil
 		}
-		coroutineParams := map[string]string{
-			InnerVarGoroutineId:       fmt.Sprintf("%v-%v", cr.TestCase.Name, i),
-			InnerVarExecutorIndex:     fmt.Sprintf("%v", i),
-			InnerVarWorkerTotal:       fmt.Sprintf("%v", cr.Info.WorkerTotal),
-			InnerVarWorkerIndex:       fmt.Sprintf("%v", cr.Info.WorkerIndex),
-			InnerVarWorkerConcurrency: fmt.Sprintf("%v", cr.Info.WorkerConcurrency),
+	}
+	return nil, fmt.Errorf("unknown step %v", stepName)
+}
+
+// SetStepRps overrides the RPS limit of a step, also while the case is
+// running. 0 makes the step unlimited.
+func (cr *CaseRunner) SetStepRps(stepName string, rps uint64) error {
+	if err := cr.overrideStepRps(stepName, rps, false); err != nil {
+		return err
+	}
+	return cr.refreshStepRps()
+}
+
+// ClearStepRps drops the override of a step and goes back to its
+// RpsLimitFunc.
+func (cr *CaseRunner) ClearStepRps(stepName string) error {
+	if err := cr.overrideStepRps(stepName, 0, true); err != nil {
+		return err
+	}
+	return cr.refreshStepRps()
+}
+
+// overrideStepRps records the override of a step, or drops it with clear,
+// without applying it.
+func (cr *CaseRunner) overrideStepRps(stepName string, rps uint64, clear bool) error {
+	ts, err := cr.stepByName(stepName)
+	if err != nil {
+		return err
+	}
+	cr.rpsLock.Lock()
+	defer cr.rpsLock.Unlock()
+	if clear {
+		delete(cr.rpsOverrides, ts.GetStepIndex())
+	} else {
+		cr.rpsOverrides[ts.GetStepIndex()] = rps
+	}
+	return nil
+}
+
+// refreshStepRps applies the current overrides. It holds paramsLock, like a
+// global params update that refreshes the limits, so the limits applied last
+// are computed from the latest overrides and params.
+func (cr *CaseRunner) refreshStepRps() error {
+	cr.paramsLock.Lock()
+	defer cr.paramsLock.Unlock()
+	return cr.refreshRpsLimits()
+}
+
+// StepRpsLimits returns the current limit of every limited step by step name.
+func (cr *CaseRunner) StepRpsLimits() map[string]uint64 {
+	cr.rpsLock.Lock()
+	rql := cr.rpsQLimiter
+	cr.rpsLock.Unlock()
+	limits := map[string]uint64{}
+	if rql == nil {
+		return limits
+	}
+	for _, ts := range cr.TestCase.Teststeps {
+		if rps := rql.limit(ts.GetStepIndex()); rps > 0 {
+			limits[ts.StepName] = rps
 		}
-		go func(gp, cp map[string]string, rql *RpsQLimiter, op *Output, _cr *CaseRunner) {
-			cr.TestCase.Run(gp, cp, rql, op, _cr)
-		}(cr.GlobalParams, coroutineParams, rpsQLimiter, cr.Output, cr)
-		cr.ActiveConcurrencyCount += 1
 	}
+	return limits
+}
+
+// GlobalParamsSnapshot is one version of the global params of a case. It is
+// never modified once published; an update publishes a new snapshot.
+type GlobalParamsSnapshot struct {
+	Version uint64
+	Params  map[string]string
+}
+
+// CurrentGlobalParams returns the latest snapshot, or nil before the first
+// SetGlobalParams or UpdateGlobalParams.
+func (cr *CaseRunner) CurrentGlobalParams() *GlobalParamsSnapshot {
+	snap, _ := cr.globalParams.Load().(*GlobalParamsSnapshot)
+	return snap
+}
+
+func (cr *CaseRunner) currentParams() map[string]string {
+	if snap := cr.CurrentGlobalParams(); snap != nil {
+		return snap.Params
+	}
+	return nil
 }
 
+// SetGlobalParams publishes a copy of globalParams as the next version.
 func (cr *CaseRunner) SetGlobalParams(globalParams map[string]string) {
-	cr.GlobalParams = globalParams
+	cr.storeGlobalParams(globalParams, 0, false)
 }
 
-func (cr *CaseRunner) StopRunChannel() {
-	cr.IsRunning = false
-	rc := cr.Output.ResChans
-	mc := cr.MetricsChan
-	time.Sleep(time.Second * 6)
-	cr.Output.ResChans = nil
-	time.Sleep(time.Second * 5)
-	close(rc)
-	time.Sleep(time.Second * 2)
-	cr.MetricsChan = nil
-	time.Sleep(time.Second * 3)
-	close(mc)
+// UpdateGlobalParams publishes a copy of globalParams as version, unless the
+// case already runs with that version or a newer one. VUs pick the new params
+// up at their next iteration, the step RPS limits are re-evaluated and
+// TestCase.OnGlobalParamsChanged is called.
+func (cr *CaseRunner) UpdateGlobalParams(version uint64, globalParams map[string]string) bool {
+	return cr.storeGlobalParams(globalParams, version, true)
+}
+
+func (cr *CaseRunner) storeGlobalParams(globalParams map[string]string, version uint64, versioned bool) bool {
+	cr.paramsLock.Lock()
+	old := cr.CurrentGlobalParams()
+	if !versioned {
+		version = 0
+		if old != nil {
+			version = old.Version + 1
+		}
+	} else if old != nil && version <= old.Version {
+		cr.paramsLock.Unlock()
+		return false
+	}
+
+	params := make(map[string]string, len(globalParams))
+	for k, v := range globalParams {
+		params[k] = v
+	}
+	cr.globalParams.Store(&GlobalParamsSnapshot{
+		Version: version,
+		Params:  params,
+	})
+	if atomic.LoadInt32(&cr.started) == 0 {
+		cr.GlobalParams = params
+	}
+
+	if err := cr.refreshRpsLimits(); err != nil {
+		fmt.Printf("CaseRunner %v failed to update its RPS limits: %v\n", cr.TestCase.Name, err)
+	}
+	// The callback runs outside paramsLock, but still one update at a time
+	// and in version order.
+	cr.notifyLock.Lock()
+	defer cr.notifyLock.Unlock()
+	cr.paramsLock.Unlock()
+	if old != nil && cr.TestCase.OnGlobalParamsChanged != nil {
+		cr.TestCase.OnGlobalParamsChanged(old.Params, params)
+	}
+	return true
+}
+
+// SetConcurrencyCap lets only the first n VUs start new iterations; the others
+// wait between iterations, keeping their CoroutineParams, until the cap is
+// raised or cleared.
+func (cr *CaseRunner) SetConcurrencyCap(n uint64) {
+	atomic.StoreInt64(&cr.concurrencyCap, int64(n))
+}
+
+// ClearConcurrencyCap lets every VU run again.
+func (cr *CaseRunner) ClearConcurrencyCap() {
+	atomic.StoreInt64(&cr.concurrencyCap, -1)
+}
+
+// waitForSlot parks a VU above the concurrency cap. VUs above the
+// concurrency target return right away so they can retire.
+func (cr *CaseRunner) waitForSlot(executorIndex int) {
+	for cr.IsRunning() {
+		c := atomic.LoadInt64(&cr.concurrencyCap)
+		if c < 0 || int64(executorIndex) < c || int64(executorIndex) >= atomic.LoadInt64(&cr.targetConcurrency) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// StopRunChannel stops the case on behalf of the coordinator.
+func (cr *CaseRunner) StopRunChannel() *DrainReport {
+	return cr.Stop(StopReasonCoordinatorStop)
+}
+
+// Stop stops the case and drains it: with RampDownSeconds the VUs are first
+// retired one by one over that time, unless the case failed, lost the
+// coordinator or was aborted locally. The remaining VUs get up to
+// DrainTimeout to finish their current iteration, then the aggregator is shut
+// down and the last metrics batch is delivered. Only the first call records
+// its reason; later calls wait for and return the same report, but a reason
+// without a ramp-down cuts one in progress short.
+func (cr *CaseRunner) Stop(reason string) *DrainReport {
+	if !rampsDown(reason) {
+		cr.halt()
+	}
+	cr.stopOnce.Do(func() {
+		defer close(cr.drained)
+		begin := time.Now()
+		paused := cr.State() == CaseStatePaused
+		cr.setState(CaseStateStopping)
+		cr.stateLock.Lock()
+		cr.stopReason = reason
+		cr.stateLock.Unlock()
+		// A paused case, or one still waiting for its start time, has no load
+		// to ramp down.
+		started := atomic.LoadInt64(&cr.vuStarted) > 0
+		rampDown := cr.Info.RampDownSeconds > 0 && !paused && started && rampsDown(reason)
+		if rampDown {
+			cr.rampDown(time.Duration(cr.Info.RampDownSeconds) * time.Second)
+		}
+		drainBy := time.Now().Add(cr.DrainTimeout)
+		if rampDown {
+			cr.waitRetired(drainBy)
+		}
+		cr.halt()
+
+		deadline := time.NewTimer(time.Until(drainBy))
+		defer deadline.Stop()
+		<-cr.rampDone
+		vusDone := make(chan struct{})
+		go func() {
+			cr.vuWg.Wait()
+			close(vusDone)
+		}()
+		select {
+		case <-vusDone:
+		case <-deadline.C:
+		}
+		clean := atomic.LoadInt64(&cr.vuExited)
+
+		cr.Output.Close()
+		<-cr.aggregatorDone
+		close(cr.MetricsChan)
+		<-cr.sendDone
+
+		report := &DrainReport{
+			CleanVUs:       clean,
+			AbandonedVUs:   atomic.LoadInt64(&cr.vuStarted) - clean,
+			DroppedResults: atomic.LoadInt64(&cr.Output.dropped),
+			Elapsed:        time.Since(begin),
+		}
+		fmt.Printf("CaseRunner %v stopped (%v), drained in %v: %v VUs exited cleanly, %v abandoned\n",
+			cr.TestCase.Name, reason, report.Elapsed, report.CleanVUs, report.AbandonedVUs)
+		cr.stateLock.Lock()
+		cr.drainReport = report
+		failed := cr.failed
+		cr.stateLock.Unlock()
+		if failed {
+			cr.setState(CaseStateError)
+		} else {
+			cr.setState(CaseStateIdle)
+		}
+	})
+	<-cr.drained
+	return cr.DrainReport()
+}
+
+// StopReason returns why the case stopped, or "" while it has not been
+// stopped.
+func (cr *CaseRunner) StopReason() string {
+	cr.stateLock.Lock()
+	defer cr.stateLock.Unlock()
+	return cr.stopReason
+}
+
+// DrainReport returns how the case stopped, or nil until Stop has drained it.
+func (cr *CaseRunner) DrainReport() *DrainReport {
+	cr.stateLock.Lock()
+	defer cr.stateLock.Unlock()
+	return cr.drainReport
+}
+
+// rampDown lowers the VUs evenly to 0 over d, and the rate of an arrival-rate
+// case with them. VUs above the falling target retire after their current
+// iteration, so ActiveConcurrencyCount follows the decline.
+func (cr *CaseRunner) rampDown(d time.Duration) {
+	cr.vuLock.Lock()
+	from := len(cr.vuAlive)
+	cr.vuLock.Unlock()
+	fmt.Printf("CaseRunner %v ramping down %v VUs over %v\n", cr.TestCase.Name, from, d)
+	cr.rampDownBegin = time.Now()
+	cr.rampDownFor = d
+	atomic.StoreInt32(&cr.rampingDown, 1)
+
+	deadline := time.NewTimer(d)
+	defer deadline.Stop()
+	ticker := time.NewTicker(loadProfileTick)
+	defer ticker.Stop()
+	for {
+		atomic.StoreInt64(&cr.targetConcurrency, int64(math.Ceil(float64(from)*cr.rampDownLeft())))
+		select {
+		case <-cr.stopCh:
+			return
+		case <-deadline.C:
+			atomic.StoreInt64(&cr.targetConcurrency, 0)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// waitRetired waits until every VU has retired after a ramp-down, or until
+// drainBy or the case is halted.
+func (cr *CaseRunner) waitRetired(drainBy time.Time) {
+	ticker := time.NewTicker(loadProfileTick)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&cr.ActiveConcurrencyCount) > 0 && time.Now().Before(drainBy) {
+		select {
+		case <-cr.stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// halt makes every VU exit after its current iteration.
+func (cr *CaseRunner) halt() {
+	cr.haltOnce.Do(func() {
+		atomic.StoreInt32(&cr.running, 0)
+		close(cr.stopCh)
+	})
+}
+
+// rampsDown reports whether a stop for reason ramps down first.
+func rampsDown(reason string) bool {
+	return reason != StopReasonError && reason != StopReasonHeartbeatLost && reason != StopReasonLocalAbort
+}
+
+func (cr *CaseRunner) isRampingDown() bool {
+	return atomic.LoadInt32(&cr.rampingDown) == 1
+}
+
+// rampDownLeft returns the part of the ramp-down still ahead, from 1 to 0.
+func (cr *CaseRunner) rampDownLeft() float64 {
+	if !cr.isRampingDown() {
+		return 1
+	}
+	left := 1 - float64(time.Since(cr.rampDownBegin))/float64(cr.rampDownFor)
+	if left < 0 {
+		return 0
+	}
+	return left
+}
+
+// Wait blocks until Stop has finished draining the case.
+func (cr *CaseRunner) Wait() {
+	<-cr.drained
+}
+
+// MetricWindows are the metric window lengths, in seconds, a case can ask for
+// with CaseBaseInfo.MetricWindowSeconds.
+var MetricWindows = []uint64{1, 5, 10, 60}
+
+func validMetricWindow(seconds uint64) bool {
+	if seconds == 0 {
+		return true
+	}
+	for _, w := range MetricWindows {
+		if w == seconds {
+			return true
+		}
+	}
+	return false
+}
+
+// metricsWindowMs returns the length of the metrics windows of the case.
+func (cr *CaseRunner) metricsWindowMs() int64 {
+	if s := cr.Info.MetricWindowSeconds; s > 0 {
+		return int64(s) * 1000
+	}
+	return 60 * 1000
+}
+
+// metricsWindow returns the number of the metrics window of t.
+func (cr *CaseRunner) metricsWindow(t time.Time) int64 {
+	return t.UnixMilli() / cr.metricsWindowMs()
+}
+
+// metricsWindowStart returns the time window begins.
+func (cr *CaseRunner) metricsWindowStart(window int64) time.Time {
+	return time.UnixMilli(window * cr.metricsWindowMs())
+}
+
+// windowKey stamps key with window: Ts is the unix minute for minute windows,
+// whether MetricWindowSeconds is 0 or 60, and otherwise the window start in
+// unix ms next to WindowMs.
+func (cr *CaseRunner) windowKey(key CallTimeMapKey, window int64) CallTimeMapKey {
+	if cr.metricsWindowMs() == 60*1000 {
+		key.Ts = window
+		return key
+	}
+	key.Ts = cr.metricsWindowStart(window).UnixMilli()
+	key.WindowMs = int(cr.metricsWindowMs())
+	return key
 }
 
 func (cr *CaseRunner) HandleOuput() {
+	defer close(cr.aggregatorDone)
 	callTimeMap := map[CallTimeMapKey]*tdigest.TDigest{}
-	lastTs := int(time.Now().UnixMilli() / 1000 / 60)
+	pausedMs := map[int64]float64{}
+	var pausedSince time.Time
+	offset := cr.clockOffset()
+	last := time.Now().Add(offset)
+	lastTs := cr.metricsWindow(last)
+	lastOffset := offset // the offset lastTs was taken with
 	for res := range cr.Output.ResChans {
-		ts := int(time.Now().UnixMilli() / 1000 / 60)
+		// Windows follow the coordinator clock, so all workers agree on them.
+		// A new estimate that puts the clock back must not reopen an earlier
+		// window.
+		offset = cr.clockOffset()
+		now := time.Now().Add(offset)
+		if now.Before(last) {
+			now = last
+		}
+		last = now
+		ts := cr.metricsWindow(now)
 		if lastTs != ts {
 			metrics := []*CallTimeMetric{}
 			for k, v := range callTimeMap {
-				outKey := k
-				outKey.Ts = lastTs
 				metrics = append(metrics, &CallTimeMetric{
-					Key:   outKey,
+					Key:   cr.windowKey(k, lastTs),
 					Value: SerializeTDigest(v),
 				})
 				if !strings.HasSuffix(k.MetricName, "_integral") {
 					delete(callTimeMap, k)
 				}
 			}
-			if len(metrics) > 0 {
-				cr.MetricsChan <- metrics
+			if !pausedSince.IsZero() {
+				cr.addPausedTime(pausedMs, pausedSince, now)
+				pausedSince = now
 			}
+			metrics = append(metrics, cr.pausedMetrics(pausedMs, ts)...)
+			cr.publishMetrics(metrics, lastOffset)
 			lastTs = ts
+			lastOffset = offset
+		}
+		if pm, ok := res.(*pauseMark); ok {
+			if pm.paused {
+				pausedSince = pm.at.Add(offset)
+			} else if !pausedSince.IsZero() {
+				cr.addPausedTime(pausedMs, pausedSince, pm.at.Add(offset))
+				pausedSince = time.Time{}
+			}
+			continue
+		}
+		if lw, ok := res.(*limiterWait); ok {
+			for _, name := range []string{MetricRpsWait, MetricRpsWait + "_integral"} {
+				key := CallTimeMapKey{
+					TaskId:      cr.Info.TaskId,
+					MetricName:  name,
+					IsWholeCase: false,
+					WorkerName:  cr.Info.WorkerName,
+					CaseName:    cr.TestCase.Name,
+					StepName:    lw.step,
+					Success:     true,
+				}
+				v := callTimeMap[key]
+				if v == nil {
+					v, _ = tdigest.New()
+					callTimeMap[key] = v
+				}
+				v.Add(float64(lw.wait) / float64(time.Millisecond))
+			}
+			res = lw.IResultV1
 		}
 		keys := []CallTimeMapKey{
 			{
+				TaskId:      cr.Info.TaskId,
 				MetricName:  "step_call",
 				IsWholeCase: true,
 				WorkerName:  cr.Info.WorkerName,
@@ -186,6 +1116,7 @@ func (cr *CaseRunner) HandleOuput() {
 				Ts:          0,
 			},
 			{
+				TaskId:      cr.Info.TaskId,
 				MetricName:  "step_call_integral",
 				IsWholeCase: true,
 				WorkerName:  cr.Info.WorkerName,
@@ -196,6 +1127,7 @@ func (cr *CaseRunner) HandleOuput() {
 				Ts:          0,
 			},
 			{
+				TaskId:      cr.Info.TaskId,
 				MetricName:  "step_call",
 				IsWholeCase: false,
 				WorkerName:  cr.Info.WorkerName,
@@ -206,6 +1138,7 @@ func (cr *CaseRunner) HandleOuput() {
 				Ts:          0,
 			},
 			{
+				TaskId:      cr.Info.TaskId,
 				MetricName:  "step_call_integral",
 				IsWholeCase: false,
 				WorkerName:  cr.Info.WorkerName,
@@ -226,27 +1159,114 @@ func (cr *CaseRunner) HandleOuput() {
 		}
 	}
 
-	nowts := int(time.Now().UnixMilli() / 1000 / 60)
+	// The digests left over belong to window lastTs, however long ago it
+	// ended. A window without calls is skipped: its integrals are the ones
+	// the previous window already reported.
+	calls := false
+	for k := range callTimeMap {
+		if !strings.HasSuffix(k.MetricName, "_integral") {
+			calls = true
+			break
+		}
+	}
 	metrics := []*CallTimeMetric{}
-	for k, v := range callTimeMap {
-		outKey := k
-		outKey.Ts = nowts
-		metrics = append(metrics, &CallTimeMetric{
-			Key:   outKey,
-			Value: SerializeTDigest(v),
-		})
-		delete(callTimeMap, k)
+	if calls {
+		for k, v := range callTimeMap {
+			metrics = append(metrics, &CallTimeMetric{
+				Key:   cr.windowKey(k, lastTs),
+				Value: SerializeTDigest(v),
+			})
+		}
 	}
-	if len(metrics) > 0 {
-		cr.MetricsChan <- metrics
+	cr.publishMetrics(metrics, lastOffset)
+
+	// The case may have been paused up to now, in later windows.
+	offset = cr.clockOffset()
+	now := time.Now().Add(offset)
+	if now.Before(last) {
+		now = last
+	}
+	nowts := cr.metricsWindow(now)
+	if nowts == lastTs {
+		offset = lastOffset
 	}
+	if !pausedSince.IsZero() {
+		cr.addPausedTime(pausedMs, pausedSince, now)
+	}
+	cr.publishMetrics(cr.pausedMetrics(pausedMs, nowts+1), offset)
 }
 
+// publishMetrics hands a batch to SendMetrics, stamped with the clock offset
+// its windows were corrected by.
+func (cr *CaseRunner) publishMetrics(metrics []*CallTimeMetric, offset time.Duration) {
+	if len(metrics) == 0 {
+		return
+	}
+	offsetMs := offset.Milliseconds()
+	for _, m := range metrics {
+		m.ClockOffsetMs = offsetMs
+	}
+	cr.MetricsChan <- metrics
+}
+
+// SendMetrics delivers metric batches in order. With a MetricsSpool the
+// batches are only appended to it and the WorkerRunner replays them.
+// Otherwise failed batches stay in a bounded buffer and are retried with
+// MetricsBackoff; once MetricsChan is closed, whatever is still undelivered
+// after DrainTimeout is dropped.
 func (cr *CaseRunner) SendMetrics() {
-	for metrics := range cr.MetricsChan {
-		targetUrl := fmt.Sprintf("%v/worker/send_step_metrics", cr.CoordinatorApi)
-		if err := cr.httpClient.PostJSON(targetUrl, metrics, nil); err != nil {
-			fmt.Println("Error sending metrics: " + err.Error())
+	defer close(cr.sendDone)
+	transport := cr.transport
+	if transport == nil {
+		transport = NewHTTPTransport(cr.CoordinatorApi, NewHTTPClient(5*time.Second))
+	}
+	backoff := cr.MetricsBackoff.orDefault(DefaultMetricsBackoff())
+	bufferSize := cr.MetricsBufferSize
+	if bufferSize <= 0 {
+		bufferSize = DefaultMetricsBufferSize
+	}
+	pending := [][]*CallTimeMetric{}
+	failures := 0
+	var retry <-chan time.Time
+	var giveUp <-chan time.Time
+	mc := cr.MetricsChan
+	for mc != nil || len(pending) > 0 {
+		select {
+		case metrics, ok := <-mc:
+			if !ok {
+				mc = nil
+				giveUp = time.After(cr.DrainTimeout)
+			} else if cr.MetricsSpool != nil {
+				if _, err := cr.MetricsSpool.Append(metrics); err != nil {
+					fmt.Println("Error spooling metrics, keeping them in memory: " + err.Error())
+					pending = append(pending, metrics)
+				}
+			} else {
+				pending = append(pending, metrics)
+				if len(pending) > bufferSize {
+					fmt.Printf("Metrics buffer full, dropping the oldest batch of %v metrics\n", len(pending[0]))
+					pending = pending[1:]
+				}
+			}
+			if failures > 0 {
+				continue
+			}
+		case <-retry:
+		case <-giveUp:
+			fmt.Printf("Giving up on %v undelivered metric batches\n", len(pending))
+			return
+		}
+
+		for len(pending) > 0 {
+			if err := transport.SendMetrics(context.Background(), pending[0]); err != nil {
+				failures++
+				delay := backoff.Delay(failures)
+				fmt.Printf("Error sending metrics (attempt %v, retrying in %v): %v\n", failures, delay, err)
+				retry = time.After(delay)
+				break
+			}
+			pending = pending[1:]
+			failures = 0
 		}
 	}
 }
@@ -0,0 +1,331 @@
+package workerclient
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type nopTransport struct{}
+
+func (nopTransport) PushStatus(context.Context, *WorkerPushStatusParams) (*RspWorkerPushStatus, error) {
+	return &RspWorkerPushStatus{}, nil
+}
+func (nopTransport) SendMetrics(context.Context, []*CallTimeMetric) error { return nil }
+func (nopTransport) ReceiveCommands(context.Context, string, func() *WorkerBaseInfo, func(*RspWorkerPushStatus)) (bool, error) {
+	return false, nil
+}
+func (nopTransport) Close() error { return nil }
+
+func TestCaseRunnerSetState(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{CaseStateIdle, CaseStatePreparing, true},
+		{CaseStateIdle, CaseStateRunning, false},
+		{CaseStateIdle, CaseStateStopping, true},
+		{CaseStatePreparing, CaseStatePreparing, false},
+		{CaseStatePreparing, CaseStateRamping, true},
+		{CaseStateRamping, CaseStateRunning, true},
+		{CaseStateRamping, CaseStatePreparing, false},
+		{CaseStateRamping, CaseStatePaused, true},
+		{CaseStateRunning, CaseStateRamping, false},
+		{CaseStateRunning, CaseStatePaused, true},
+		{CaseStateRunning, CaseStateStopping, true},
+		{CaseStatePaused, CaseStateRamping, false},
+		{CaseStatePaused, CaseStateStopping, true},
+		{CaseStateStopping, CaseStatePreparing, false},
+		{CaseStateStopping, CaseStateIdle, true},
+		{CaseStateStopping, CaseStateError, true},
+		{CaseStateError, CaseStatePreparing, false},
+	}
+	for _, tt := range tests {
+		cr := NewCaseRunner(CaseRunnerInfo{}, NewTestCase("c"), nil)
+		cr.state = tt.from
+		got := cr.setState(tt.to)
+		if got != tt.want {
+			t.Errorf("%v -> %v: setState = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+		want := tt.from
+		if tt.want {
+			want = tt.to
+		}
+		if s := cr.State(); s != want {
+			t.Errorf("%v -> %v: state %v, want %v", tt.from, tt.to, s, want)
+		}
+	}
+}
+
+func TestCaseRunnerRampEndsWhilePaused(t *testing.T) {
+	cr := NewCaseRunner(CaseRunnerInfo{}, NewTestCase("c"), nil)
+	cr.state = CaseStateRamping
+	if err := cr.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	if !cr.setState(CaseStateRunning) || cr.State() != CaseStatePaused {
+		t.Fatalf("state %v, want the case to stay paused", cr.State())
+	}
+	if err := cr.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if s := cr.State(); s != CaseStateRunning {
+		t.Fatalf("resumed to %v, want %v", s, CaseStateRunning)
+	}
+	if err := cr.Resume(); err != nil {
+		t.Fatalf("Resume of a running case: %v", err)
+	}
+	marks := 0
+	for len(cr.Output.ResChans) > 0 {
+		if _, ok := (<-cr.Output.ResChans).(*pauseMark); ok {
+			marks++
+		}
+	}
+	if marks != 2 {
+		t.Fatalf("%v pause marks, want 2", marks)
+	}
+}
+
+func TestCaseRunnerStopBeforeRun(t *testing.T) {
+	cr := NewCaseRunner(CaseRunnerInfo{MaxConcurrencyInThisWoker: 1}, NewTestCase("c"), nil)
+	stopped := make(chan *DrainReport)
+	go func() { stopped <- cr.Stop(StopReasonLocalAbort) }()
+	for cr.State() != CaseStateStopping {
+		time.Sleep(time.Millisecond)
+	}
+	cr.Run()
+	select {
+	case report := <-stopped:
+		if report.CleanVUs != 0 || report.AbandonedVUs != 0 {
+			t.Fatalf("report %+v, want no VUs", report)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop did not return")
+	}
+	if s := cr.State(); s != CaseStateIdle {
+		t.Fatalf("state %v, want %v", s, CaseStateIdle)
+	}
+	// A second Run must not start anything either.
+	cr.Run()
+}
+
+func TestCaseRunnerRetiredVUKeepsIndexUntilTearDown(t *testing.T) {
+	var tearingDown, overlaps, restarted int32
+	tc := NewTestCase("c")
+	tc.AddStep(&TestStep{
+		StepName: "s1",
+		ReqPluginFunc: func(map[string]string) IResultV1 {
+			r := AcquireResult("s1")
+			r.Begin()
+			r.End()
+			return r
+		},
+		GenReqParamsFunc: func(cp *CaseParams) map[string]string {
+			if cp.CoroutineParams[InnerVarExecutorIndex] == "1" {
+				if atomic.LoadInt32(&tearingDown) == 1 {
+					atomic.AddInt32(&overlaps, 1)
+				}
+				atomic.AddInt32(&restarted, 1)
+			}
+			return map[string]string{}
+		},
+	})
+	tc.TearDown = func(cp map[string]string) {
+		if cp[InnerVarExecutorIndex] == "1" && atomic.CompareAndSwapInt32(&tearingDown, 0, 1) {
+			time.Sleep(300 * time.Millisecond)
+			atomic.StoreInt32(&restarted, 0)
+			atomic.StoreInt32(&tearingDown, 0)
+		}
+	}
+	cr := NewCaseRunner(CaseRunnerInfo{MaxConcurrencyInThisWoker: 2}, tc, nopTransport{})
+	go cr.Run()
+	time.Sleep(150 * time.Millisecond)
+
+	cr.SetConcurrency(1)
+	for atomic.LoadInt32(&tearingDown) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt64(&cr.ActiveConcurrencyCount); n != 2 {
+		t.Errorf("ActiveConcurrencyCount = %v during TearDown, want 2", n)
+	}
+	cr.SetConcurrency(2)
+	time.Sleep(600 * time.Millisecond)
+	if n := atomic.LoadInt32(&overlaps); n != 0 {
+		t.Errorf("a new VU ran at index 1 %v times before TearDown finished", n)
+	}
+	if atomic.LoadInt32(&restarted) == 0 {
+		t.Error("no VU was restarted at index 1 after TearDown")
+	}
+
+	cr.Stop(StopReasonLocalAbort)
+	if n := atomic.LoadInt64(&cr.ActiveConcurrencyCount); n != 0 {
+		t.Errorf("ActiveConcurrencyCount = %v after Stop, want 0", n)
+	}
+}
+
+func TestApplyRpsLimitsPanicChangesNothing(t *testing.T) {
+	tc := NewTestCase("c")
+	for _, name := range []string{"a", "b"} {
+		name := name
+		tc.AddStep(&TestStep{
+			StepName: name,
+			RpsLimitFunc: func(_ CaseRunnerInfo, gp map[string]string) uint64 {
+				if gp["x"] == "" {
+					return 10
+				}
+				if name == "b" {
+					panic("bad param")
+				}
+				return 20
+			},
+		})
+	}
+	cr := NewCaseRunner(CaseRunnerInfo{}, tc, nil)
+	rql, err := cr.newRpsQLimiter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr.SetGlobalParams(map[string]string{"x": "1"})
+	if err := cr.applyRpsLimits(rql); err == nil {
+		t.Fatal("applyRpsLimits ignored the panic")
+	}
+	for _, ts := range tc.Teststeps {
+		if rps := rql.limit(ts.GetStepIndex()); rps != 10 {
+			t.Errorf("step %v limit %v, want it unchanged at 10", ts.StepName, rps)
+		}
+	}
+}
+
+func TestUpdateGlobalParamsCallbackOutsideLock(t *testing.T) {
+	tc := NewTestCase("c")
+	cr := NewCaseRunner(CaseRunnerInfo{}, tc, nil)
+	var versions []string
+	tc.OnGlobalParamsChanged = func(oldParams, newParams map[string]string) {
+		if !cr.paramsLock.TryLock() {
+			t.Error("OnGlobalParamsChanged called under paramsLock")
+			return
+		}
+		cr.paramsLock.Unlock()
+		versions = append(versions, oldParams["v"]+"->"+newParams["v"])
+	}
+	cr.UpdateGlobalParams(1, map[string]string{"v": "1"})
+	atomic.StoreInt32(&cr.started, 1)
+	cr.UpdateGlobalParams(2, map[string]string{"v": "2"})
+	if cr.UpdateGlobalParams(2, map[string]string{"v": "x"}) {
+		t.Error("same version applied twice")
+	}
+	if len(versions) != 1 || versions[0] != "1->2" {
+		t.Errorf("callbacks %v, want [1->2]", versions)
+	}
+	if cr.GlobalParams["v"] != "1" || cr.CurrentGlobalParams().Params["v"] != "2" {
+		t.Errorf("GlobalParams %v, current %v; want the start params and version 2", cr.GlobalParams, cr.CurrentGlobalParams().Params)
+	}
+}
+
+func TestSetConcurrencyArrivalRate(t *testing.T) {
+	cr := NewCaseRunner(CaseRunnerInfo{Executor: ExecutorArrivalRate, ArrivalRate: &ArrivalRate{Rate: 1, MaxVUs: 4}}, NewTestCase("c"), nil)
+	if err := cr.SetConcurrency(2); err != ErrArrivalRateConcurrency {
+		t.Fatalf("SetConcurrency = %v, want %v", err, ErrArrivalRateConcurrency)
+	}
+}
+
+func TestLimitedStepSendsOneResult(t *testing.T) {
+	tc := NewTestCase("c")
+	tc.AddStep(&TestStep{
+		StepName: "s1",
+		ReqPluginFunc: func(map[string]string) IResultV1 {
+			return AcquireResult("s1")
+		},
+		GenReqParamsFunc: func(*CaseParams) map[string]string { return map[string]string{} },
+		RpsLimitFunc:     func(CaseRunnerInfo, map[string]string) uint64 { return 100 },
+	})
+	cr := NewCaseRunner(CaseRunnerInfo{}, tc, nil)
+	rql, err := cr.newRpsQLimiter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.runIteration(&CaseParams{CoroutineParams: map[string]string{}}, rql, cr.Output, cr)
+	if n := len(cr.Output.ResChans); n != 1 {
+		t.Fatalf("%v results sent, want 1", n)
+	}
+	lw, ok := (<-cr.Output.ResChans).(*limiterWait)
+	if !ok || lw.step != "s1" || lw.GetName() != "s1" {
+		t.Fatalf("result %+v, want the step result carrying its wait", lw)
+	}
+}
+
+func TestLocalAbortCutsRampDownShort(t *testing.T) {
+	tc := NewTestCase("c")
+	tc.AddStep(&TestStep{
+		StepName: "s1",
+		ReqPluginFunc: func(map[string]string) IResultV1 {
+			return AcquireResult("s1")
+		},
+		GenReqParamsFunc: func(*CaseParams) map[string]string { return map[string]string{} },
+	})
+	cr := NewCaseRunner(CaseRunnerInfo{MaxConcurrencyInThisWoker: 2, RampDownSeconds: 30}, tc, nopTransport{})
+	go cr.Run()
+	for atomic.LoadInt64(&cr.ActiveConcurrencyCount) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	go cr.Stop(StopReasonCoordinatorStop)
+	for !cr.isRampingDown() {
+		time.Sleep(time.Millisecond)
+	}
+	begin := time.Now()
+	report := cr.Stop(StopReasonLocalAbort)
+	if d := time.Since(begin); d > 5*time.Second {
+		t.Fatalf("Stop took %v during a 30s ramp-down", d)
+	}
+	if cr.StopReason() != StopReasonCoordinatorStop || report.CleanVUs != 2 {
+		t.Fatalf("reason %v, report %+v; want the first reason and 2 clean VUs", cr.StopReason(), report)
+	}
+}
+
+func TestStopWhileWaitingForStartSkipsRampDown(t *testing.T) {
+	info := CaseRunnerInfo{MaxConcurrencyInThisWoker: 2, RampDownSeconds: 30, StartAt: time.Now().Add(time.Hour)}
+	cr := NewCaseRunner(info, NewTestCase("c"), nopTransport{})
+	go cr.Run()
+	for cr.State() != CaseStatePreparing {
+		time.Sleep(time.Millisecond)
+	}
+	begin := time.Now()
+	cr.Stop(StopReasonCoordinatorStop)
+	if d := time.Since(begin); d > 5*time.Second {
+		t.Fatalf("Stop took %v before any VU started", d)
+	}
+	if cr.isRampingDown() {
+		t.Fatal("ramped down a case without VUs")
+	}
+}
+
+func TestMetricsWindowKey(t *testing.T) {
+	at := time.UnixMilli(1_760_608_812_345)
+	tests := []struct {
+		seconds      uint64
+		wantWindow   int64
+		wantTs       int64
+		wantWindowMs int
+	}{
+		{0, 29_343_480, 29_343_480, 0},
+		{60, 29_343_480, 29_343_480, 0},
+		{1, 1_760_608_812, 1_760_608_812_000, 1000},
+		{5, 352_121_762, 1_760_608_810_000, 5000},
+		{10, 176_060_881, 1_760_608_810_000, 10000},
+	}
+	for _, tt := range tests {
+		cr := NewCaseRunner(CaseRunnerInfo{MetricWindowSeconds: tt.seconds}, NewTestCase("c"), nil)
+		w := cr.metricsWindow(at)
+		if w != tt.wantWindow {
+			t.Errorf("%vs: metricsWindow = %v, want %v", tt.seconds, w, tt.wantWindow)
+		}
+		if start := cr.metricsWindowStart(w); start.After(at) || !cr.metricsWindowStart(w+1).After(at) {
+			t.Errorf("%vs: window %v starts at %v, not containing %v", tt.seconds, w, start, at)
+		}
+		key := cr.windowKey(CallTimeMapKey{MetricName: "step_call"}, w)
+		if key.Ts != tt.wantTs || key.WindowMs != tt.wantWindowMs {
+			t.Errorf("%vs: windowKey = ts %v windowMs %v, want %v %v", tt.seconds, key.Ts, key.WindowMs, tt.wantTs, tt.wantWindowMs)
+		}
+	}
+}
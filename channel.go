@@ -0,0 +1,233 @@
+package workerclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Modes for WorkerRunner.CommandChannel.
+const (
+	CommandChannelNone      = ""
+	CommandChannelWebSocket = "websocket" // falls back to long-poll when the upgrade fails
+	CommandChannelLongPoll  = "longpoll"
+)
+
+const (
+	// LongPollWait is how long the coordinator may hold a wait_command call.
+	LongPollWait = 30 * time.Second
+	// commandChannelPing is the WebSocket ping interval; the connection is
+	// considered dead after two intervals without any frame from the coordinator.
+	commandChannelPing = 30 * time.Second
+	// webSocketRetry is how long the worker stays on long-poll before it tries
+	// to upgrade to a WebSocket again.
+	webSocketRetry = 5 * time.Minute
+)
+
+// WorkerWaitCommandParams is the body of a long-poll wait_command call. The
+// coordinator answers with a RspWorkerPushStatusBody as soon as it has a
+// command for the worker, or with empty data after WaitMs.
+type WorkerWaitCommandParams struct {
+	BaseInfo *WorkerBaseInfo `json:"baseInfo" binding:"required"`
+	WaitMs   int64           `json:"waitMs"`
+}
+
+var errChannelClosed = errors.New("command channel closed")
+
+// ErrCommandChannelUnsupported is returned by ReceiveCommands when the
+// coordinator cannot push commands. The worker then relies on polling.
+var ErrCommandChannelUnsupported = errors.New("coordinator does not support the command channel")
+
+// runCommandChannel keeps a persistent command channel to the coordinator
+// open until ctx is done. Commands received on it are handled like a
+// push_status response, so start and stop take effect without waiting for
+// the next poll. Polling keeps running and takes over while the channel is
+// down.
+func (rw *WorkerRunner) runCommandChannel(ctx context.Context) {
+	failures := 0
+	for ctx.Err() == nil {
+		connected, err := rw.transport.ReceiveCommands(ctx, rw.CommandChannel, rw.baseInfoSnapshot, rw.handleChannelCommand)
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, ErrCommandChannelUnsupported) {
+			fmt.Printf("Command channel unavailable, relying on push_status polling: %v\n", err)
+			return
+		}
+		// Reconnect at once only after a channel that worked ended cleanly;
+		// anything else backs off, so a transport that cannot connect does
+		// not spin.
+		if connected {
+			if err == nil {
+				continue
+			}
+			failures = 0
+		} else {
+			failures++
+		}
+		if err == nil {
+			err = errChannelClosed
+		}
+		delay := rw.PollBackoff.orDefault(DefaultPollBackoff()).Delay(failures)
+		fmt.Printf("Command channel down, retrying in %v: %v\n", delay, err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+	}
+}
+
+// baseInfoSnapshot returns a copy of the worker info that is safe to encode
+// outside rw.lock.
+func (rw *WorkerRunner) baseInfoSnapshot() *WorkerBaseInfo {
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+	return rw.Worker.BaseInfo.clone()
+}
+
+// handleChannelCommand applies a command received on the channel.
+func (rw *WorkerRunner) handleChannelCommand(rsp *RspWorkerPushStatus) {
+	defer func() {
+		if p := recover(); p != nil {
+			fmt.Printf("Command channel Error: %v\n", p)
+		}
+	}()
+	if rsp == nil {
+		return
+	}
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+	rw.handleCommand(rsp)
+}
+
+// ReceiveCommands uses a WebSocket for CommandChannelWebSocket, falling back
+// to long-poll for a while when the upgrade fails, and long-poll otherwise.
+func (t *HTTPTransport) ReceiveCommands(ctx context.Context, mode string, baseInfo func() *WorkerBaseInfo, handle func(*RspWorkerPushStatus)) (connected bool, err error) {
+	if mode == CommandChannelWebSocket {
+		connected, err = t.runWebSocketChannel(ctx, baseInfo(), handle)
+		if connected || ctx.Err() != nil {
+			return connected, err
+		}
+		fmt.Printf("Command channel websocket unavailable, falling back to long-poll: %v\n", err)
+		return t.runLongPollChannel(ctx, webSocketRetry, baseInfo, handle)
+	}
+	return t.runLongPollChannel(ctx, 0, baseInfo, handle)
+}
+
+func (t *HTTPTransport) commandChannelURL(baseInfo *WorkerBaseInfo) (string, error) {
+	u, err := url.Parse(t.CoordinatorApi)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/worker/command_channel"
+	q := url.Values{}
+	q.Set("workerId", baseInfo.ID)
+	q.Set("workerName", baseInfo.Name)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// runWebSocketChannel reads commands from a WebSocket until it breaks.
+// connected reports whether the upgrade succeeded.
+func (t *HTTPTransport) runWebSocketChannel(ctx context.Context, baseInfo *WorkerBaseInfo, handle func(*RspWorkerPushStatus)) (connected bool, err error) {
+	target, err := t.commandChannelURL(baseInfo)
+	if err != nil {
+		return false, err
+	}
+	header := http.Header{}
+	if t.client.auth != nil {
+		req, err := http.NewRequest("GET", target, nil)
+		if err != nil {
+			return false, err
+		}
+		if err := t.client.auth.Authenticate(req, nil); err != nil {
+			return false, fmt.Errorf("failed to authenticate request: %w", err)
+		}
+		header = req.Header
+	}
+
+	dialer := &websocket.Dialer{
+		HandshakeTimeout: t.client.opts.Timeout,
+	}
+	if tr, ok := t.client.client.Transport.(*http.Transport); ok {
+		dialer.TLSClientConfig = tr.TLSClientConfig
+		dialer.Proxy = tr.Proxy
+	}
+	conn, _, err := dialer.DialContext(ctx, target, header)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	fmt.Println("Command channel connected over websocket")
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(commandChannelPing)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				conn.Close()
+				return
+			case <-stop:
+				return
+			case <-ticker.C:
+				conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(t.client.opts.Timeout))
+			}
+		}
+	}()
+
+	extend := func() {
+		conn.SetReadDeadline(time.Now().Add(2 * commandChannelPing))
+	}
+	extend()
+	conn.SetPongHandler(func(string) error {
+		extend()
+		return nil
+	})
+	for {
+		rsp := &RspWorkerPushStatusBody{}
+		if err := conn.ReadJSON(rsp); err != nil {
+			return true, err
+		}
+		extend()
+		handle(rsp.Data)
+	}
+}
+
+// runLongPollChannel waits for commands with long-poll calls until one fails
+// or maxDuration (if > 0) has passed. connected reports whether at least one
+// call succeeded.
+func (t *HTTPTransport) runLongPollChannel(ctx context.Context, maxDuration time.Duration, baseInfo func() *WorkerBaseInfo, handle func(*RspWorkerPushStatus)) (connected bool, err error) {
+	targetUrl := fmt.Sprintf("%v/worker/wait_command", t.CoordinatorApi)
+	begin := time.Now()
+	for ctx.Err() == nil {
+		if maxDuration > 0 && time.Since(begin) >= maxDuration {
+			return connected, nil
+		}
+		params := &WorkerWaitCommandParams{
+			BaseInfo: baseInfo(),
+			WaitMs:   LongPollWait.Milliseconds(),
+		}
+		rsp := &RspWorkerPushStatusBody{}
+		if err := t.client.postJSON(ctx, targetUrl, LongPollWait+t.client.opts.Timeout, params, rsp); err != nil {
+			return connected, err
+		}
+		connected = true
+		handle(rsp.Data)
+	}
+	return connected, errChannelClosed
+}
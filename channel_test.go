@@ -0,0 +1,134 @@
+package workerclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// unreachableChannel is a transport whose command channel never connects.
+type unreachableChannel struct {
+	nopTransport
+	calls int32
+}
+
+func (u *unreachableChannel) ReceiveCommands(context.Context, string, func() *WorkerBaseInfo, func(*RspWorkerPushStatus)) (bool, error) {
+	atomic.AddInt32(&u.calls, 1)
+	return false, nil
+}
+
+func TestRunCommandChannelBacksOffWithoutConnection(t *testing.T) {
+	u := &unreachableChannel{}
+	rw := NewWorkerRunner("w", "", WithCoordinatorTransport(u))
+	rw.PollBackoff = Backoff{Interval: 20 * time.Millisecond, MaxInterval: 20 * time.Millisecond, Multiplier: 1}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	rw.runCommandChannel(ctx)
+	if n := atomic.LoadInt32(&u.calls); n > 10 {
+		t.Fatalf("%v connection attempts in 100ms with a 20ms backoff", n)
+	}
+}
+
+// coordinatorMux accepts the metrics of the cases a channel test starts.
+func coordinatorMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/worker/send_step_metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	})
+	return mux
+}
+
+// runChannel runs the command channel of a worker for coordinatorApi until
+// case name has been started over it, then stops both.
+func runChannel(t *testing.T, coordinatorApi, mode, name string) {
+	t.Helper()
+	rw := NewWorkerRunner("w", coordinatorApi)
+	fastPolls(rw)
+	rw.CommandChannel = mode
+	rw.AddTestCase(loopCase(name))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		rw.runCommandChannel(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	for begin := time.Now(); ; time.Sleep(time.Millisecond) {
+		rw.lock.Lock()
+		cr := rw.CaseRunners[name]
+		rw.lock.Unlock()
+		if cr != nil {
+			cr.Stop(StopReasonLocalAbort)
+			return
+		}
+		if time.Since(begin) > 5*time.Second {
+			t.Fatal("the command sent over the channel was not applied")
+		}
+	}
+}
+
+func TestCommandChannelWebSocket(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	mux := coordinatorMux()
+	mux.HandleFunc("/worker/command_channel", func(w http.ResponseWriter, r *http.Request) {
+		if name := r.URL.Query().Get("workerName"); name != "w" {
+			t.Errorf("workerName = %q, want w", name)
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteJSON(&RspWorkerPushStatusBody{Data: startCommand("c", "t1", 1)})
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+	mux.HandleFunc("/worker/wait_command", func(w http.ResponseWriter, r *http.Request) {
+		t.Error("fell back to long-poll although the websocket connected")
+		http.NotFound(w, r)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	runChannel(t, srv.URL, CommandChannelWebSocket, "c")
+}
+
+func TestCommandChannelFallsBackToLongPoll(t *testing.T) {
+	var polls int32
+	mux := coordinatorMux()
+	mux.HandleFunc("/worker/command_channel", http.NotFound)
+	mux.HandleFunc("/worker/wait_command", func(w http.ResponseWriter, r *http.Request) {
+		params := &WorkerWaitCommandParams{}
+		if err := json.NewDecoder(r.Body).Decode(params); err != nil || params.BaseInfo == nil || params.BaseInfo.Name != "w" || params.WaitMs != LongPollWait.Milliseconds() {
+			t.Errorf("wait_command body %+v, %v", params, err)
+		}
+		rsp := &RspWorkerPushStatusBody{}
+		if atomic.AddInt32(&polls, 1) == 1 {
+			rsp.Data = startCommand("c", "t1", 1)
+		} else {
+			// No command; answer before the long-poll wait to keep the test short.
+			select {
+			case <-r.Context().Done():
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+		json.NewEncoder(w).Encode(rsp)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	runChannel(t, srv.URL, CommandChannelWebSocket, "c")
+}
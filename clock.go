@@ -0,0 +1,113 @@
+package workerclient
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// clockSamples is how many push_status round trips the clock offset is
+// estimated from.
+const clockSamples = 8
+
+type clockSample struct {
+	offset time.Duration // coordinator clock minus worker clock
+	rtt    time.Duration
+}
+
+// clockEstimator estimates the offset of the coordinator clock from
+// push_status round trips, the way NTP does: of the last clockSamples round
+// trips, the shortest has the least room for asymmetric delay and wins.
+type clockEstimator struct {
+	lock    sync.Mutex
+	samples []clockSample
+}
+
+// add records a round trip sent and received on the worker clock, answered at
+// serverMs on the coordinator clock.
+func (ce *clockEstimator) add(sent, received time.Time, serverMs int64) {
+	rtt := received.Sub(sent)
+	mid := sent.Add(rtt / 2)
+	ce.lock.Lock()
+	defer ce.lock.Unlock()
+	ce.samples = append(ce.samples, clockSample{
+		offset: time.UnixMilli(serverMs).Sub(mid),
+		rtt:    rtt,
+	})
+	if len(ce.samples) > clockSamples {
+		ce.samples = ce.samples[len(ce.samples)-clockSamples:]
+	}
+}
+
+// estimate returns the offset of the coordinator clock and the round trip it
+// was measured with, and false before the first measurement.
+func (ce *clockEstimator) estimate() (offset, rtt time.Duration, ok bool) {
+	ce.lock.Lock()
+	defer ce.lock.Unlock()
+	for i, s := range ce.samples {
+		if i == 0 || s.rtt < rtt {
+			offset, rtt = s.offset, s.rtt
+		}
+	}
+	return offset, rtt, len(ce.samples) > 0
+}
+
+// ClockOffset returns how far the coordinator clock is ahead of the worker
+// clock, and false until push_status has measured it.
+func (rw *WorkerRunner) ClockOffset() (time.Duration, bool) {
+	offset, _, ok := rw.clock.estimate()
+	return offset, ok
+}
+
+// coordinatorTime converts unix milliseconds on the coordinator clock to the
+// worker clock.
+func (rw *WorkerRunner) coordinatorTime(ms int64) time.Time {
+	offset, _ := rw.ClockOffset()
+	return time.UnixMilli(ms).Add(-offset)
+}
+
+// clockOffset returns how far the coordinator clock is ahead of the worker
+// clock, 0 until it has been measured.
+func (cr *CaseRunner) clockOffset() time.Duration {
+	if cr.clock == nil {
+		return 0
+	}
+	offset, _, _ := cr.clock.estimate()
+	return offset
+}
+
+// adjustResultClock moves the begin and end times of res to the coordinator
+// clock, if res supports it.
+func (cr *CaseRunner) adjustResultClock(res IResultV1) {
+	if offsetMs := cr.clockOffset().Milliseconds(); offsetMs != 0 {
+		if r, ok := res.(interface{ ShiftTimes(ms int64) }); ok {
+			r.ShiftTimes(offsetMs)
+		}
+	}
+}
+
+// MaxStartDelay is how far ahead of the worker clock a start time may be. A
+// case with a later start time is rejected.
+const MaxStartDelay = 24 * time.Hour
+
+// waitForStart waits for Info.StartAt, and returns false if the case was
+// stopped meanwhile.
+func (cr *CaseRunner) waitForStart() bool {
+	if cr.Info.StartAt.IsZero() {
+		return true
+	}
+	d := time.Until(cr.Info.StartAt)
+	if d <= 0 {
+		fmt.Printf("CaseRunner %v starts %v after its start time\n", cr.TestCase.Name, -d)
+		return true
+	}
+	fmt.Printf("CaseRunner %v starts in %v\n", cr.TestCase.Name, d)
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-cr.stopCh:
+		return false
+	}
+}
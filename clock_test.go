@@ -0,0 +1,137 @@
+package workerclient
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClockEstimatorMinRTT(t *testing.T) {
+	base := time.UnixMilli(1_700_000_000_000)
+	// sample is a round trip of rtt starting at sent seconds, answered by a
+	// coordinator clock offset ahead of the worker clock.
+	type sample struct {
+		sent   int
+		rtt    time.Duration
+		offset time.Duration
+	}
+	tests := []struct {
+		name       string
+		samples    []sample
+		wantOffset time.Duration
+		wantRTT    time.Duration
+		wantOK     bool
+	}{
+		{"no samples", nil, 0, 0, false},
+		{"one sample", []sample{{0, 40 * time.Millisecond, time.Second}}, time.Second, 40 * time.Millisecond, true},
+		{"shortest round trip wins", []sample{
+			{0, 200 * time.Millisecond, 3 * time.Second},
+			{1, 10 * time.Millisecond, time.Second},
+			{2, 300 * time.Millisecond, -2 * time.Second},
+		}, time.Second, 10 * time.Millisecond, true},
+		{"first of equal round trips wins", []sample{
+			{0, 20 * time.Millisecond, 500 * time.Millisecond},
+			{1, 20 * time.Millisecond, 900 * time.Millisecond},
+		}, 500 * time.Millisecond, 20 * time.Millisecond, true},
+		{"old samples are forgotten", append([]sample{{0, time.Millisecond, 5 * time.Second}},
+			func() []sample {
+				var s []sample
+				for i := 1; i <= clockSamples; i++ {
+					s = append(s, sample{i, 50 * time.Millisecond, -time.Second})
+				}
+				return s
+			}()...), -time.Second, 50 * time.Millisecond, true},
+	}
+	for _, tt := range tests {
+		var ce clockEstimator
+		for _, s := range tt.samples {
+			sent := base.Add(time.Duration(s.sent) * time.Second)
+			received := sent.Add(s.rtt)
+			ce.add(sent, received, sent.Add(s.rtt/2).Add(s.offset).UnixMilli())
+		}
+		offset, rtt, ok := ce.estimate()
+		if offset != tt.wantOffset || rtt != tt.wantRTT || ok != tt.wantOK {
+			t.Errorf("%v: estimate = %v %v %v, want %v %v %v", tt.name, offset, rtt, ok, tt.wantOffset, tt.wantRTT, tt.wantOK)
+		}
+	}
+}
+
+func TestHandleOuputClockStepsBack(t *testing.T) {
+	cr := NewCaseRunner(CaseRunnerInfo{MetricWindowSeconds: 1}, NewTestCase("c"), nil)
+	cr.clock = &clockEstimator{}
+	sent := time.Now()
+	cr.clock.add(sent, sent.Add(100*time.Millisecond), sent.Add(50*time.Millisecond).UnixMilli())
+	go cr.HandleOuput()
+
+	cr.Output.Send(AcquireResult("s1"))
+	for len(cr.Output.ResChans) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// A better round trip puts the coordinator clock 5s behind.
+	sent = time.Now()
+	cr.clock.add(sent, sent.Add(10*time.Millisecond), sent.Add(5*time.Millisecond-5*time.Second).UnixMilli())
+	cr.Output.Send(AcquireResult("s1"))
+	cr.Output.Close()
+	<-cr.aggregatorDone
+	close(cr.MetricsChan)
+
+	var lastTs int64
+	for batch := range cr.MetricsChan {
+		for _, m := range batch {
+			if m.Key.Ts < lastTs {
+				t.Fatalf("window %v after window %v", m.Key.Ts, lastTs)
+			}
+			lastTs = m.Key.Ts
+			if m.ClockOffsetMs != 0 {
+				t.Fatalf("ClockOffsetMs = %v, want the 0 the window was taken with", m.ClockOffsetMs)
+			}
+		}
+	}
+	if lastTs == 0 {
+		t.Fatal("no metrics published")
+	}
+}
+
+func TestHandleOuputFlushesLastWindow(t *testing.T) {
+	tests := []struct {
+		name  string
+		pause bool // pause after the first window, so the last one has no calls
+	}{
+		{"idle until close", false},
+		{"paused until close", true},
+	}
+	for _, tt := range tests {
+		cr := NewCaseRunner(CaseRunnerInfo{MetricWindowSeconds: 1}, NewTestCase("c"), nil)
+		// Start right after a window boundary, so the result lands in window w.
+		w := cr.metricsWindow(time.Now()) + 1
+		time.Sleep(time.Until(cr.metricsWindowStart(w).Add(10 * time.Millisecond)))
+		go cr.HandleOuput()
+		cr.Output.Send(AcquireResult("s1"))
+
+		// Close after the result's window ended.
+		time.Sleep(time.Until(cr.metricsWindowStart(w + 1).Add(10 * time.Millisecond)))
+		if tt.pause {
+			cr.Output.Send(&pauseMark{at: time.Now(), paused: true})
+		}
+		cr.Output.Close()
+		<-cr.aggregatorDone
+		close(cr.MetricsChan)
+
+		want := cr.windowKey(CallTimeMapKey{}, w).Ts
+		calls := 0
+		for batch := range cr.MetricsChan {
+			for _, m := range batch {
+				if m.Key.MetricName == MetricCasePaused {
+					continue
+				}
+				if m.Key.Ts != want {
+					t.Errorf("%v: %v stamped with window %v, want %v", tt.name, m.Key.MetricName, m.Key.Ts, want)
+				}
+				calls++
+			}
+		}
+		// step_call and step_call_integral, for the case and for the step.
+		if calls != 4 {
+			t.Errorf("%v: %v call metrics, want 4", tt.name, calls)
+		}
+	}
+}
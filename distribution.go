@@ -0,0 +1,118 @@
+package workerclient
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Built-in inter-arrival distributions of an ArrivalDistribution.
+const (
+	DistributionConstant    = "constant"    // every gap is the mean
+	DistributionExponential = "exponential" // Poisson process
+	DistributionUniform     = "uniform"     // uniform between 0 and twice the mean
+	DistributionNormal      = "normal"      // normal around the mean, see ArrivalDistribution.StdDev
+)
+
+// maxArrivalLag is how far pacing may fall behind before it skips ahead
+// instead of bursting to catch up.
+const maxArrivalLag = time.Second
+
+// InterArrivalFunc draws the gap before the next arrival, given the mean gap
+// of the current rate. rng is only used by one goroutine at a time.
+type InterArrivalFunc func(rng *rand.Rand, mean time.Duration) time.Duration
+
+var (
+	distributionsLock sync.RWMutex
+	distributions     = map[string]InterArrivalFunc{
+		DistributionConstant: func(rng *rand.Rand, mean time.Duration) time.Duration {
+			return mean
+		},
+		DistributionExponential: func(rng *rand.Rand, mean time.Duration) time.Duration {
+			return time.Duration(rng.ExpFloat64() * float64(mean))
+		},
+		DistributionUniform: func(rng *rand.Rand, mean time.Duration) time.Duration {
+			return time.Duration(rng.Float64() * 2 * float64(mean))
+		},
+	}
+)
+
+// RegisterDistribution makes fn available as ArrivalDistribution.Type name.
+// It replaces a distribution registered under the same name.
+func RegisterDistribution(name string, fn InterArrivalFunc) {
+	distributionsLock.Lock()
+	defer distributionsLock.Unlock()
+	distributions[name] = fn
+}
+
+// ArrivalDistribution chooses the gaps between arrival-rate iterations and
+// between runs of rate-limited steps. Without one, both are evenly spaced.
+type ArrivalDistribution struct {
+	Type   string  `json:"type"`   // a Distribution* constant or a name given to RegisterDistribution
+	StdDev float64 `json:"stdDev"` // standard deviation of DistributionNormal, as a fraction of the mean
+	Seed   int64   `json:"seed"`   // seeds the RNG of every worker; 0 picks a random seed
+}
+
+func (ad *ArrivalDistribution) interArrivalFunc() (InterArrivalFunc, error) {
+	if ad.Type == DistributionNormal {
+		stdDev := ad.StdDev
+		return func(rng *rand.Rand, mean time.Duration) time.Duration {
+			gap := float64(mean) * (1 + rng.NormFloat64()*stdDev)
+			if gap < 0 {
+				return 0
+			}
+			return time.Duration(gap)
+		}, nil
+	}
+	distributionsLock.RLock()
+	defer distributionsLock.RUnlock()
+	fn := distributions[ad.Type]
+	if fn == nil {
+		return nil, fmt.Errorf("unknown arrival distribution %q", ad.Type)
+	}
+	return fn, nil
+}
+
+// arrivalSampler draws gaps of one arrival stream from its own RNG, so a
+// seeded run draws the same gaps however goroutines interleave.
+type arrivalSampler struct {
+	rng *rand.Rand
+	fn  InterArrivalFunc
+}
+
+// gap draws the gap before the next arrival at rate arrivals per second. A
+// nil sampler spaces arrivals evenly.
+func (s *arrivalSampler) gap(rate float64) time.Duration {
+	mean := time.Duration(float64(time.Second) / rate)
+	if s == nil {
+		return mean
+	}
+	return s.fn(s.rng, mean)
+}
+
+// newSampler returns the sampler of stream, or nil if the case has no
+// ArrivalDistribution. Stream 0 paces iterations, stream i+1 paces step i.
+func (cr *CaseRunner) newSampler(stream int64) (*arrivalSampler, error) {
+	ad := cr.Info.ArrivalDistribution
+	if ad == nil {
+		return nil, nil
+	}
+	fn, err := ad.interArrivalFunc()
+	if err != nil {
+		return nil, err
+	}
+	// Workers and streams draw different, but reproducible, gaps.
+	seed := cr.arrivalSeed + int64(cr.Info.WorkerIndex)*1000003 + stream
+	return &arrivalSampler{rng: rand.New(rand.NewSource(seed)), fn: fn}, nil
+}
+
+// newStepSampler returns the sampler of the step with index key.
+func (cr *CaseRunner) newStepSampler(key string) (*arrivalSampler, error) {
+	idx, err := strconv.ParseInt(key, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse step index %v: %w", key, err)
+	}
+	return cr.newSampler(idx + 1)
+}
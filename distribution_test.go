@@ -0,0 +1,106 @@
+package workerclient
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// drawGaps draws n gaps at rate from stream of a case on worker workerIndex.
+func drawGaps(t *testing.T, ad *ArrivalDistribution, workerIndex uint64, stream int64, rate float64, n int) []time.Duration {
+	t.Helper()
+	cr := NewCaseRunner(CaseRunnerInfo{WorkerIndex: workerIndex, ArrivalDistribution: ad}, NewTestCase("c"), nil)
+	s, err := cr.newSampler(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gaps := make([]time.Duration, n)
+	for i := range gaps {
+		gaps[i] = s.gap(rate)
+	}
+	return gaps
+}
+
+func equalGaps(a, b []time.Duration) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return len(a) == len(b)
+}
+
+func TestArrivalSamplerIsReproducible(t *testing.T) {
+	ad := &ArrivalDistribution{Type: DistributionExponential, Seed: 42}
+	gaps := drawGaps(t, ad, 1, 0, 10, 100)
+	if again := drawGaps(t, ad, 1, 0, 10, 100); !equalGaps(gaps, again) {
+		t.Fatal("the same seed, worker and stream drew different gaps")
+	}
+	if other := drawGaps(t, ad, 2, 0, 10, 100); equalGaps(gaps, other) {
+		t.Error("two workers drew the same gaps")
+	}
+	if other := drawGaps(t, ad, 1, 1, 10, 100); equalGaps(gaps, other) {
+		t.Error("two streams drew the same gaps")
+	}
+}
+
+func TestArrivalDistributionMeans(t *testing.T) {
+	const rate = 100 // a mean gap of 10ms
+	mean := 10 * time.Millisecond
+	tests := []*ArrivalDistribution{
+		{Type: DistributionConstant, Seed: 7},
+		{Type: DistributionExponential, Seed: 7},
+		{Type: DistributionUniform, Seed: 7},
+		{Type: DistributionNormal, StdDev: 0.2, Seed: 7},
+	}
+	for _, ad := range tests {
+		gaps := drawGaps(t, ad, 0, 0, rate, 20000)
+		var sum time.Duration
+		for _, g := range gaps {
+			if g < 0 {
+				t.Fatalf("%v: negative gap %v", ad.Type, g)
+			}
+			sum += g
+		}
+		got := sum / time.Duration(len(gaps))
+		if math.Abs(float64(got-mean)) > 0.03*float64(mean) {
+			t.Errorf("%v: mean gap %v, want %v", ad.Type, got, mean)
+		}
+	}
+
+	var s *arrivalSampler
+	if g := s.gap(rate); g != mean {
+		t.Errorf("gap without a distribution %v, want %v", g, mean)
+	}
+}
+
+func TestNewRpsQLimiterDistribution(t *testing.T) {
+	const name = "test-half"
+	RegisterDistribution(name, func(rng *rand.Rand, mean time.Duration) time.Duration {
+		return mean / 2
+	})
+	defer func() {
+		distributionsLock.Lock()
+		delete(distributions, name)
+		distributionsLock.Unlock()
+	}()
+
+	tests := []struct {
+		typ     string
+		wantErr bool
+	}{
+		{DistributionExponential, false},
+		{name, false},
+		{"pareto", true},
+	}
+	for _, tt := range tests {
+		cr := NewCaseRunner(CaseRunnerInfo{ArrivalDistribution: &ArrivalDistribution{Type: tt.typ}}, NewTestCase("c"), nil)
+		if _, err := cr.newRpsQLimiter(); (err != nil) != tt.wantErr {
+			t.Errorf("%v: newRpsQLimiter error %v, want error %v", tt.typ, err, tt.wantErr)
+		}
+	}
+	if g := drawGaps(t, &ArrivalDistribution{Type: name}, 0, 0, 10, 1)[0]; g != 50*time.Millisecond {
+		t.Errorf("registered distribution drew %v, want 50ms", g)
+	}
+}
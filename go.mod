@@ -5,6 +5,16 @@ go 1.19
 require (
 	github.com/Narasimha1997/ratelimiter v1.1.1
 	github.com/caio/go-tdigest/v4 v4.0.1
-	github.com/eapache/queue v1.1.0
 	github.com/google/uuid v1.3.0
+	github.com/gorilla/websocket v1.5.0
+	google.golang.org/grpc v1.56.3
+	google.golang.org/protobuf v1.30.0
+)
+
+require (
+	github.com/golang/protobuf v1.5.3 // indirect
+	golang.org/x/net v0.17.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+	google.golang.org/genproto v0.0.0-20230410155749-daa745c078e1 // indirect
 )
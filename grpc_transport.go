@@ -0,0 +1,510 @@
+package workerclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// The gRPC coordinator service described in coordinator.proto. Messages are
+// deliberately google.protobuf.BytesValue holding the same JSON documents as
+// the HTTP protocol, so both transports stay in sync without generated code.
+const (
+	grpcServiceName         = "workerclient.Coordinator"
+	grpcMethodPushStatus    = "/" + grpcServiceName + "/PushStatus"
+	grpcMethodWatchCommands = "/" + grpcServiceName + "/WatchCommands"
+	grpcMethodStreamMetrics = "/" + grpcServiceName + "/StreamMetrics"
+	grpcMethodSendMetrics   = "/" + grpcServiceName + "/SendMetrics"
+)
+
+// DefaultGRPCTimeout bounds a gRPC call whose context has no deadline.
+const DefaultGRPCTimeout = 30 * time.Second
+
+var (
+	grpcWatchCommandsDesc = grpc.StreamDesc{
+		StreamName:    "WatchCommands",
+		ServerStreams: true,
+	}
+	grpcStreamMetricsDesc = grpc.StreamDesc{
+		StreamName:    "StreamMetrics",
+		ServerStreams: true,
+		ClientStreams: true,
+	}
+)
+
+// GRPCTransport talks to the coordinator over gRPC. Metric batches share one
+// long-lived bidirectional stream; the coordinator acknowledges each batch
+// in order. Commands are always watched for, see WatchCommands.
+type GRPCTransport struct {
+	Timeout time.Duration
+	// Auth, if set, authenticates every call together with its payload, which
+	// grpc.WithPerRPCCredentials cannot see. Metric batches are then sent as
+	// unary SendMetrics calls, so that each batch is signed.
+	Auth          Authenticator
+	conn          *grpc.ClientConn
+	lock          sync.Mutex
+	metrics       grpc.ClientStream
+	cancelMetrics context.CancelFunc
+}
+
+// NewGRPCTransport dials target lazily with opts, e.g.
+// grpc.WithTransportCredentials and grpc.WithPerRPCCredentials.
+func NewGRPCTransport(target string, opts ...grpc.DialOption) (*GRPCTransport, error) {
+	conn, err := grpc.Dial(target, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial coordinator: %w", err)
+	}
+	return &GRPCTransport{
+		Timeout: DefaultGRPCTimeout,
+		conn:    conn,
+	}, nil
+}
+
+func (t *GRPCTransport) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || t.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, t.Timeout)
+}
+
+func (t *GRPCTransport) PushStatus(ctx context.Context, params *WorkerPushStatusParams) (*RspWorkerPushStatus, error) {
+	in, err := marshalBytesValue(params)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := t.withTimeout(ctx)
+	defer cancel()
+	if ctx, err = t.signedContext(ctx, grpcMethodPushStatus, in.Value); err != nil {
+		return nil, err
+	}
+	out := &wrapperspb.BytesValue{}
+	if err := t.conn.Invoke(ctx, grpcMethodPushStatus, in, out); err != nil {
+		return nil, err
+	}
+	rsp := &RspWorkerPushStatus{}
+	if err := json.Unmarshal(out.Value, rsp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return rsp, nil
+}
+
+func (t *GRPCTransport) SendMetrics(ctx context.Context, metrics []*CallTimeMetric) error {
+	in, err := marshalBytesValue(metrics)
+	if err != nil {
+		return err
+	}
+	if t.Auth != nil {
+		return t.sendSignedMetrics(ctx, in)
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.metrics == nil {
+		streamCtx, cancel := context.WithCancel(context.Background())
+		stream, err := t.conn.NewStream(streamCtx, &grpcStreamMetricsDesc, grpcMethodStreamMetrics)
+		if err != nil {
+			cancel()
+			return fmt.Errorf("failed to open metrics stream: %w", err)
+		}
+		t.metrics, t.cancelMetrics = stream, cancel
+	}
+
+	ctx, cancel := t.withTimeout(ctx)
+	defer cancel()
+	stream := t.metrics
+	done := make(chan error, 1)
+	go func() {
+		if err := stream.SendMsg(in); err != nil {
+			done <- err
+			return
+		}
+		out := &wrapperspb.BytesValue{}
+		if err := stream.RecvMsg(out); err != nil {
+			done <- err
+			return
+		}
+		ack := &ResponseBody{}
+		if err := json.Unmarshal(out.Value, ack); err != nil {
+			done <- fmt.Errorf("failed to unmarshal metrics ack: %w", err)
+			return
+		}
+		if ack.Code != 0 {
+			done <- fmt.Errorf("coordinator rejected metrics: %v", ack.Msg)
+			return
+		}
+		done <- nil
+	}()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		// The stream may be out of step with its acks now, start a new one.
+		t.cancelMetrics()
+		t.metrics, t.cancelMetrics = nil, nil
+	}
+	return err
+}
+
+// sendSignedMetrics sends one batch as a unary call signed with t.Auth.
+func (t *GRPCTransport) sendSignedMetrics(ctx context.Context, in *wrapperspb.BytesValue) error {
+	ctx, cancel := t.withTimeout(ctx)
+	defer cancel()
+	ctx, err := t.signedContext(ctx, grpcMethodSendMetrics, in.Value)
+	if err != nil {
+		return err
+	}
+	out := &wrapperspb.BytesValue{}
+	if err := t.conn.Invoke(ctx, grpcMethodSendMetrics, in, out); err != nil {
+		return err
+	}
+	ack := &ResponseBody{}
+	if err := json.Unmarshal(out.Value, ack); err != nil {
+		return fmt.Errorf("failed to unmarshal metrics ack: %w", err)
+	}
+	if ack.Code != 0 {
+		return fmt.Errorf("coordinator rejected metrics: %v", ack.Msg)
+	}
+	return nil
+}
+
+// signedContext adds the headers of t.Auth for a call of method with body to
+// the outgoing metadata of ctx.
+func (t *GRPCTransport) signedContext(ctx context.Context, method string, body []byte) (context.Context, error) {
+	if t.Auth == nil {
+		return ctx, nil
+	}
+	req := grpcRequest(method, http.Header{})
+	if err := t.Auth.Authenticate(req, body); err != nil {
+		return nil, fmt.Errorf("failed to authenticate request: %w", err)
+	}
+	kv := []string{}
+	for k, v := range req.Header {
+		if len(v) > 0 {
+			kv = append(kv, strings.ToLower(k), v[0])
+		}
+	}
+	return metadata.AppendToOutgoingContext(ctx, kv...), nil
+}
+
+// grpcRequest returns the request an Authenticator signs for a gRPC call:
+// a POST to the full method name, without a host.
+func grpcRequest(method string, header http.Header) *http.Request {
+	return &http.Request{
+		Method: "POST",
+		URL:    &url.URL{Path: method},
+		Header: header,
+	}
+}
+
+// pushesCommands tells the WorkerRunner to watch for commands even without
+// a CommandChannel.
+func (t *GRPCTransport) pushesCommands() bool {
+	return true
+}
+
+// ReceiveCommands reads commands from a WatchCommands stream. mode is
+// ignored, gRPC always pushes. A coordinator without WatchCommands makes it
+// return ErrCommandChannelUnsupported.
+func (t *GRPCTransport) ReceiveCommands(ctx context.Context, mode string, baseInfo func() *WorkerBaseInfo, handle func(*RspWorkerPushStatus)) (connected bool, err error) {
+	in, err := marshalBytesValue(baseInfo())
+	if err != nil {
+		return false, err
+	}
+	streamCtx, err := t.signedContext(ctx, grpcMethodWatchCommands, in.Value)
+	if err != nil {
+		return false, err
+	}
+	stream, err := t.conn.NewStream(streamCtx, &grpcWatchCommandsDesc, grpcMethodWatchCommands)
+	if err != nil {
+		return false, grpcCommandsError(err)
+	}
+	if err := stream.SendMsg(in); err != nil {
+		return false, grpcCommandsError(err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		return false, err
+	}
+	if _, err := stream.Header(); err != nil {
+		return false, grpcCommandsError(err)
+	}
+	for {
+		out := &wrapperspb.BytesValue{}
+		if err := stream.RecvMsg(out); err != nil {
+			// An Unimplemented answer carries no header, so it surfaces here.
+			err = grpcCommandsError(err)
+			return !errors.Is(err, ErrCommandChannelUnsupported), err
+		}
+		rsp := &RspWorkerPushStatus{}
+		if err := json.Unmarshal(out.Value, rsp); err != nil {
+			return true, fmt.Errorf("failed to unmarshal command: %w", err)
+		}
+		handle(rsp)
+	}
+}
+
+func grpcCommandsError(err error) error {
+	if status.Code(err) == codes.Unimplemented {
+		return fmt.Errorf("%w: %v", ErrCommandChannelUnsupported, err)
+	}
+	return err
+}
+
+func (t *GRPCTransport) Close() error {
+	t.lock.Lock()
+	if t.cancelMetrics != nil {
+		t.cancelMetrics()
+		t.metrics, t.cancelMetrics = nil, nil
+	}
+	t.lock.Unlock()
+	return t.conn.Close()
+}
+
+func marshalBytesValue(v interface{}) (*wrapperspb.BytesValue, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+	return wrapperspb.Bytes(data), nil
+}
+
+// authenticatorCredentials adapts an Authenticator to gRPC per-RPC
+// credentials. Signatures cover the service URI and an empty body, so use
+// GRPCTransport.Auth for HMACSigner.
+type authenticatorCredentials struct {
+	auth       Authenticator
+	requireTLS bool
+}
+
+// GRPCCredentials sends the headers added by auth as gRPC metadata on every
+// call. Use it with grpc.WithPerRPCCredentials for bearer tokens; it cannot
+// sign the payload of a call.
+func GRPCCredentials(auth Authenticator, requireTLS bool) credentials.PerRPCCredentials {
+	return &authenticatorCredentials{auth: auth, requireTLS: requireTLS}
+}
+
+func (c *authenticatorCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	target := ""
+	if len(uri) > 0 {
+		target = uri[0]
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.auth.Authenticate(req, nil); err != nil {
+		return nil, fmt.Errorf("failed to authenticate request: %w", err)
+	}
+	md := map[string]string{}
+	for k, v := range req.Header {
+		if len(v) > 0 {
+			md[strings.ToLower(k)] = v[0]
+		}
+	}
+	return md, nil
+}
+
+func (c *authenticatorCredentials) RequireTransportSecurity() bool {
+	return c.requireTLS
+}
+
+// CoordinatorServer is implemented by coordinators that accept workers over
+// gRPC. Register it with RegisterCoordinatorServer.
+type CoordinatorServer interface {
+	PushStatus(ctx context.Context, params *WorkerPushStatusParams) (*RspWorkerPushStatus, error)
+	// WatchCommands pushes commands for the worker with send until ctx is
+	// done or send fails.
+	WatchCommands(ctx context.Context, baseInfo *WorkerBaseInfo, send func(*RspWorkerPushStatus) error) error
+	// SendMetrics stores one metric batch; an error is returned to the worker,
+	// which retries the batch.
+	SendMetrics(ctx context.Context, metrics []*CallTimeMetric) error
+}
+
+// RequestVerifier may be implemented by a CoordinatorServer to authenticate
+// calls. VerifyRequest gets the full method name and the raw payload of
+// PushStatus, SendMetrics and WatchCommands calls, e.g. for VerifyGRPCHMAC.
+// StreamMetrics batches cannot be verified one by one, so the stream is
+// verified when it opens, with an empty payload; workers with
+// GRPCTransport.Auth use SendMetrics instead.
+type RequestVerifier interface {
+	VerifyRequest(ctx context.Context, method string, body []byte) error
+}
+
+// VerifyGRPCHMAC checks a gRPC call signed by a GRPCTransport with an
+// HMACSigner as its Auth, like VerifyHMACRequest does for HTTP.
+func VerifyGRPCHMAC(ctx context.Context, method string, body []byte, secrets map[string][]byte, maxSkew time.Duration, nonces *NonceCache) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	header := http.Header{}
+	for _, k := range []string{HeaderSignatureKeyId, HeaderSignatureTimestamp, HeaderSignatureNonce, HeaderSignature} {
+		if v := md.Get(k); len(v) > 0 {
+			header.Set(k, v[0])
+		}
+	}
+	return VerifyHMACRequest(grpcRequest(method, header), body, secrets, maxSkew, nonces)
+}
+
+// verifyGRPCRequest runs the RequestVerifier of srv, if it has one.
+func verifyGRPCRequest(ctx context.Context, srv interface{}, method string, body []byte) error {
+	v, ok := srv.(RequestVerifier)
+	if !ok {
+		return nil
+	}
+	if err := v.VerifyRequest(ctx, method, body); err != nil {
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+	return nil
+}
+
+func RegisterCoordinatorServer(s grpc.ServiceRegistrar, srv CoordinatorServer) {
+	s.RegisterService(&grpcCoordinatorServiceDesc, srv)
+}
+
+var grpcCoordinatorServiceDesc = grpc.ServiceDesc{
+	ServiceName: grpcServiceName,
+	HandlerType: (*CoordinatorServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "PushStatus",
+			Handler:    grpcPushStatusHandler,
+		},
+		{
+			MethodName: "SendMetrics",
+			Handler:    grpcSendMetricsHandler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchCommands",
+			Handler:       grpcWatchCommandsHandler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "StreamMetrics",
+			Handler:       grpcStreamMetricsHandler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "coordinator.proto",
+}
+
+func grpcPushStatusHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := &wrapperspb.BytesValue{}
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	call := func(ctx context.Context, req interface{}) (interface{}, error) {
+		body := req.(*wrapperspb.BytesValue).Value
+		if err := verifyGRPCRequest(ctx, srv, grpcMethodPushStatus, body); err != nil {
+			return nil, err
+		}
+		params := &WorkerPushStatusParams{}
+		if err := json.Unmarshal(body, params); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		rsp, err := srv.(CoordinatorServer).PushStatus(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		return marshalBytesValue(rsp)
+	}
+	if interceptor == nil {
+		return call(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: grpcMethodPushStatus,
+	}
+	return interceptor(ctx, in, info, call)
+}
+
+func grpcSendMetricsHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := &wrapperspb.BytesValue{}
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	call := func(ctx context.Context, req interface{}) (interface{}, error) {
+		body := req.(*wrapperspb.BytesValue).Value
+		if err := verifyGRPCRequest(ctx, srv, grpcMethodSendMetrics, body); err != nil {
+			return nil, err
+		}
+		return marshalBytesValue(storeGRPCMetrics(ctx, srv, body))
+	}
+	if interceptor == nil {
+		return call(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: grpcMethodSendMetrics,
+	}
+	return interceptor(ctx, in, info, call)
+}
+
+// storeGRPCMetrics passes one encoded batch to srv and returns the ack.
+func storeGRPCMetrics(ctx context.Context, srv interface{}, body []byte) *ResponseBody {
+	ack := &ResponseBody{}
+	metrics := []*CallTimeMetric{}
+	if err := json.Unmarshal(body, &metrics); err != nil {
+		ack.Code, ack.Msg = int(codes.InvalidArgument), err.Error()
+	} else if err := srv.(CoordinatorServer).SendMetrics(ctx, metrics); err != nil {
+		ack.Code, ack.Msg = int(codes.Internal), err.Error()
+	}
+	return ack
+}
+
+func grpcWatchCommandsHandler(srv interface{}, stream grpc.ServerStream) error {
+	in := &wrapperspb.BytesValue{}
+	if err := stream.RecvMsg(in); err != nil {
+		return err
+	}
+	if err := verifyGRPCRequest(stream.Context(), srv, grpcMethodWatchCommands, in.Value); err != nil {
+		return err
+	}
+	baseInfo := &WorkerBaseInfo{}
+	if err := json.Unmarshal(in.Value, baseInfo); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := stream.SendHeader(nil); err != nil {
+		return err
+	}
+	return srv.(CoordinatorServer).WatchCommands(stream.Context(), baseInfo, func(rsp *RspWorkerPushStatus) error {
+		out, err := marshalBytesValue(rsp)
+		if err != nil {
+			return err
+		}
+		return stream.SendMsg(out)
+	})
+}
+
+func grpcStreamMetricsHandler(srv interface{}, stream grpc.ServerStream) error {
+	if err := verifyGRPCRequest(stream.Context(), srv, grpcMethodStreamMetrics, nil); err != nil {
+		return err
+	}
+	for {
+		in := &wrapperspb.BytesValue{}
+		if err := stream.RecvMsg(in); err != nil {
+			return err
+		}
+		out, err := marshalBytesValue(storeGRPCMetrics(stream.Context(), srv, in.Value))
+		if err != nil {
+			return err
+		}
+		if err := stream.SendMsg(out); err != nil {
+			return err
+		}
+	}
+}
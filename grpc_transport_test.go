@@ -0,0 +1,144 @@
+package workerclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// fakeCoordinatorServer answers pushes with a start command, rejects metric
+// batches named "bad" and pushes one command to every watcher.
+type fakeCoordinatorServer struct {
+	lock    sync.Mutex
+	pushed  []string // worker names of the pushes
+	batches []string // metric names of the stored batches
+}
+
+func (s *fakeCoordinatorServer) PushStatus(_ context.Context, params *WorkerPushStatusParams) (*RspWorkerPushStatus, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pushed = append(s.pushed, params.BaseInfo.Name)
+	return startCommand("c", "t1", 3), nil
+}
+
+func (s *fakeCoordinatorServer) WatchCommands(ctx context.Context, _ *WorkerBaseInfo, send func(*RspWorkerPushStatus) error) error {
+	if err := send(startCommand("c", "t2", 1)); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func (s *fakeCoordinatorServer) SendMetrics(_ context.Context, metrics []*CallTimeMetric) error {
+	name := metrics[0].Key.MetricName
+	if name == "bad" {
+		return errors.New("rejected")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.batches = append(s.batches, name)
+	return nil
+}
+
+// serveCoordinator serves desc for srv in process and returns a transport
+// connected to it.
+func serveCoordinator(t *testing.T, desc *grpc.ServiceDesc, srv CoordinatorServer) *GRPCTransport {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	s := grpc.NewServer()
+	s.RegisterService(desc, srv)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	transport, err := NewGRPCTransport("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { transport.Close() })
+	return transport
+}
+
+func TestGRPCTransport(t *testing.T) {
+	srv := &fakeCoordinatorServer{}
+	transport := serveCoordinator(t, &grpcCoordinatorServiceDesc, srv)
+	ctx := context.Background()
+
+	rsp, err := transport.PushStatus(ctx, &WorkerPushStatusParams{BaseInfo: &WorkerBaseInfo{Name: "w"}})
+	if err != nil || !rsp.ShouldRunCase || rsp.TestCaseInfo.BaseInfo.TaskId != "t1" {
+		t.Fatalf("PushStatus = %+v, %v", rsp, err)
+	}
+
+	// The batches share one stream; a rejected one is acked with an error and
+	// the next batch goes through.
+	for _, tt := range []struct {
+		name    string
+		wantErr bool
+	}{{"a", false}, {"bad", true}, {"b", false}} {
+		err := transport.SendMetrics(ctx, spoolBatch(tt.name))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("SendMetrics(%v) = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+	srv.lock.Lock()
+	if len(srv.pushed) != 1 || srv.pushed[0] != "w" || len(srv.batches) != 2 || srv.batches[0] != "a" || srv.batches[1] != "b" {
+		t.Errorf("coordinator got pushes %v and batches %v", srv.pushed, srv.batches)
+	}
+	srv.lock.Unlock()
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var got *RspWorkerPushStatus
+	connected, err := transport.ReceiveCommands(watchCtx, CommandChannelNone, func() *WorkerBaseInfo {
+		return &WorkerBaseInfo{Name: "w"}
+	}, func(rsp *RspWorkerPushStatus) {
+		got = rsp
+		cancel()
+	})
+	if !connected || got == nil || got.TestCaseInfo.BaseInfo.TaskId != "t2" {
+		t.Fatalf("ReceiveCommands = %v, %v with command %+v", connected, err, got)
+	}
+}
+
+func TestGRPCWatchCommandsUnimplementedFallsBackToPolling(t *testing.T) {
+	// A coordinator that predates WatchCommands.
+	desc := grpcCoordinatorServiceDesc
+	desc.Streams = nil
+	for _, sd := range grpcCoordinatorServiceDesc.Streams {
+		if sd.StreamName != "WatchCommands" {
+			desc.Streams = append(desc.Streams, sd)
+		}
+	}
+	transport := serveCoordinator(t, &desc, &fakeCoordinatorServer{})
+
+	connected, err := transport.ReceiveCommands(context.Background(), CommandChannelNone, func() *WorkerBaseInfo {
+		return &WorkerBaseInfo{Name: "w"}
+	}, func(*RspWorkerPushStatus) {})
+	if connected || !errors.Is(err, ErrCommandChannelUnsupported) {
+		t.Fatalf("ReceiveCommands = %v, %v; want ErrCommandChannelUnsupported", connected, err)
+	}
+
+	// The worker gives up on the channel and keeps polling.
+	rw := NewWorkerRunner("w", "", WithCoordinatorTransport(transport))
+	done := make(chan struct{})
+	go func() {
+		rw.runCommandChannel(context.Background())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("runCommandChannel kept retrying WatchCommands")
+	}
+	if err := transport.SendMetrics(context.Background(), spoolBatch("a")); err != nil {
+		t.Fatalf("StreamMetrics after the fallback: %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package workerclient
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// Interpolation modes of a LoadStage.
+const (
+	StageLinear = "linear" // move evenly from the previous target to Target over the stage
+	StageStep   = "step"   // jump to Target when the stage begins
+)
+
+// StopReasonProfileComplete is reported when the last stage of a LoadProfile
+// has ended.
+const StopReasonProfileComplete = "profile_complete"
+
+// loadProfileTick is how often a CaseRunner re-evaluates its LoadProfile.
+const loadProfileTick = 100 * time.Millisecond
+
+// LoadStage moves the case to Target VUs, counted across all workers, over
+// DurationSeconds. With ExecutorArrivalRate Target is iterations per second
+// and may be fractional; VU targets are rounded to whole VUs.
+type LoadStage struct {
+	Target          float64 `json:"target"`
+	DurationSeconds uint64  `json:"durationSeconds"`
+	Interpolation   string  `json:"interpolation"` // StageLinear (default) or StageStep
+}
+
+// LoadProfile shapes the number of VUs of a case over time. The case starts
+// at 0 VUs and runs the stages in order; it stops once the last stage ends.
+type LoadProfile struct {
+	Stages []*LoadStage `json:"stages"`
+}
+
+// Target returns the total VUs the profile asks for elapsed after the start,
+// and false once the last stage has ended.
+func (p *LoadProfile) Target(elapsed time.Duration) (uint64, bool) {
+	t, ok := p.target(elapsed)
+	return uint64(math.Round(t)), ok
+}
+
+// target is Target without rounding, for profiles of arrival rates.
+func (p *LoadProfile) target(elapsed time.Duration) (float64, bool) {
+	from := float64(0)
+	begin := time.Duration(0)
+	for _, st := range p.Stages {
+		d := time.Duration(st.DurationSeconds) * time.Second
+		if elapsed < begin+d {
+			if st.Interpolation == StageStep {
+				return st.Target, true
+			}
+			frac := float64(elapsed-begin) / float64(d)
+			return from + (st.Target-from)*frac, true
+		}
+		begin += d
+		from = st.Target
+	}
+	return from, false
+}
+
+// MaxTarget returns the highest target of all stages, in whole VUs.
+func (p *LoadProfile) MaxTarget() uint64 {
+	max := float64(0)
+	for _, st := range p.Stages {
+		if st.Target > max {
+			max = st.Target
+		}
+	}
+	return uint64(math.Ceil(max))
+}
+
+// workerShare splits total VUs across workers: each worker takes up to
+// workerConcurrency VUs, in worker index order.
+func workerShare(total, workerConcurrency uint64, workerIndex int64) uint64 {
+	remaining := int64(total) - int64(workerConcurrency)*workerIndex
+	if remaining <= 0 {
+		return 0
+	}
+	if remaining < int64(workerConcurrency) {
+		return uint64(remaining)
+	}
+	return workerConcurrency
+}
+
+// runLoadProfile scales the case along Info.LoadProfile until it is stopped,
+// and stops it when the profile ends. Stage targets are totals across workers;
+// this worker follows its workerShare of them.
+func (cr *CaseRunner) runLoadProfile(begin time.Time) {
+	ticker := time.NewTicker(loadProfileTick)
+	defer ticker.Stop()
+	for {
+		if cr.isRampingDown() {
+			return
+		}
+		total, ok := cr.Info.LoadProfile.Target(cr.activeSince(begin))
+		if !ok {
+			cr.Stop(StopReasonProfileComplete)
+			return
+		}
+		n := workerShare(total, cr.Info.WorkerConcurrency, int64(cr.Info.WorkerIndex))
+		if int64(n) != atomic.LoadInt64(&cr.targetConcurrency) {
+			cr.SetConcurrency(n)
+		}
+		select {
+		case <-cr.stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (cr *CaseRunner) hasLoadProfile() bool {
+	return cr.Info.LoadProfile != nil && len(cr.Info.LoadProfile.Stages) > 0
+}
@@ -0,0 +1,40 @@
+package workerclient
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoadProfileTarget(t *testing.T) {
+	p := &LoadProfile{Stages: []*LoadStage{
+		{Target: 0.5, DurationSeconds: 10},
+		{Target: 0.5, DurationSeconds: 10},
+		{Target: 3, DurationSeconds: 10, Interpolation: StageStep},
+	}}
+	tests := []struct {
+		elapsed time.Duration
+		want    float64
+		ok      bool
+	}{
+		{0, 0, true},
+		{5 * time.Second, 0.25, true},
+		{15 * time.Second, 0.5, true},
+		{20 * time.Second, 3, true},
+		{30 * time.Second, 3, false},
+	}
+	for _, tt := range tests {
+		got, ok := p.target(tt.elapsed)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("target(%v) = %v %v, want %v %v", tt.elapsed, got, ok, tt.want, tt.ok)
+		}
+	}
+	if n, _ := p.Target(15 * time.Second); n != 1 {
+		t.Errorf("Target(15s) = %v VUs, want 1", n)
+	}
+	if max := p.MaxTarget(); max != 3 {
+		t.Errorf("MaxTarget = %v, want 3", max)
+	}
+	if max := (&LoadProfile{Stages: []*LoadStage{{Target: 0.5}}}).MaxTarget(); max != 1 {
+		t.Errorf("MaxTarget of a 0.5 stage = %v, want 1", max)
+	}
+}
@@ -0,0 +1,150 @@
+package workerclient
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/caio/go-tdigest/v4"
+)
+
+// MetricCasePaused is the metric of how many milliseconds of a metrics window
+// the case was paused. Windows without a pause have no such metric.
+const MetricCasePaused = "case_paused"
+
+// pauseMark tells the aggregator that the case was paused or resumed.
+type pauseMark struct {
+	Result
+	at     time.Time
+	paused bool
+}
+
+// Pause holds the load of a ramping or running case. VUs block before their
+// next step with their CoroutineParams intact, and an arrival-rate case starts
+// no new iterations. Pausing a paused case does nothing.
+func (cr *CaseRunner) Pause() error {
+	cr.pauseLock.Lock()
+	defer cr.pauseLock.Unlock()
+	cr.stateLock.Lock()
+	if cr.state == CaseStatePaused {
+		cr.stateLock.Unlock()
+		return nil
+	}
+	if !canTransition(cr.state, CaseStatePaused) {
+		err := fmt.Errorf("cannot pause case %v while %v", cr.TestCase.Name, cr.state)
+		cr.stateLock.Unlock()
+		return err
+	}
+	cr.pausedFrom = cr.state
+	cr.state = CaseStatePaused
+	cr.pausedAt = time.Now()
+	at := cr.pausedAt
+	cr.resumeCh.Store(make(chan struct{}))
+	cr.stateLock.Unlock()
+
+	cr.Output.Send(&pauseMark{at: at, paused: true})
+	fmt.Printf("CaseRunner %v paused\n", cr.TestCase.Name)
+	return nil
+}
+
+// Resume releases the VUs of a paused case. Resuming a case that is not
+// paused does nothing.
+func (cr *CaseRunner) Resume() error {
+	cr.pauseLock.Lock()
+	defer cr.pauseLock.Unlock()
+	cr.stateLock.Lock()
+	switch cr.state {
+	case CaseStatePaused:
+	case CaseStateRamping, CaseStateRunning:
+		cr.stateLock.Unlock()
+		return nil
+	default:
+		err := fmt.Errorf("cannot resume case %v while %v", cr.TestCase.Name, cr.state)
+		cr.stateLock.Unlock()
+		return err
+	}
+	now := time.Now()
+	paused := now.Sub(cr.pausedAt)
+	cr.state = cr.pausedFrom
+	cr.pausedTotal += paused
+	close(cr.resumed())
+	cr.stateLock.Unlock()
+
+	cr.Output.Send(&pauseMark{at: now})
+	fmt.Printf("CaseRunner %v resumed after %v\n", cr.TestCase.Name, paused)
+	return nil
+}
+
+// resumed returns a channel that is closed unless the case is paused.
+func (cr *CaseRunner) resumed() chan struct{} {
+	return cr.resumeCh.Load().(chan struct{})
+}
+
+func (cr *CaseRunner) isPaused() bool {
+	select {
+	case <-cr.resumed():
+		return false
+	default:
+		return true
+	}
+}
+
+// waitWhilePaused blocks while the case is paused, until it is resumed or
+// stopped.
+func (cr *CaseRunner) waitWhilePaused() {
+	select {
+	case <-cr.resumed():
+	case <-cr.stopCh:
+	}
+}
+
+// activeSince returns the time since begin that the case was not paused.
+func (cr *CaseRunner) activeSince(begin time.Time) time.Duration {
+	cr.stateLock.Lock()
+	defer cr.stateLock.Unlock()
+	paused := cr.pausedTotal
+	if cr.state == CaseStatePaused {
+		paused += time.Since(cr.pausedAt)
+	}
+	return time.Since(begin) - paused
+}
+
+// addPausedTime adds the time from from to to, in milliseconds, to every
+// metrics window it overlaps.
+func (cr *CaseRunner) addPausedTime(pausedMs map[int64]float64, from, to time.Time) {
+	for from.Before(to) {
+		w := cr.metricsWindow(from)
+		end := cr.metricsWindowStart(w + 1)
+		if end.After(to) {
+			end = to
+		}
+		pausedMs[w] += float64(end.Sub(from)) / float64(time.Millisecond)
+		from = end
+	}
+}
+
+// pausedMetrics turns the paused time of the windows before window into
+// MetricCasePaused metrics.
+func (cr *CaseRunner) pausedMetrics(pausedMs map[int64]float64, window int64) []*CallTimeMetric {
+	metrics := []*CallTimeMetric{}
+	for w, ms := range pausedMs {
+		if w >= window {
+			continue
+		}
+		td, _ := tdigest.New()
+		td.Add(ms)
+		metrics = append(metrics, &CallTimeMetric{
+			Key: cr.windowKey(CallTimeMapKey{
+				TaskId:      cr.Info.TaskId,
+				MetricName:  MetricCasePaused,
+				IsWholeCase: true,
+				WorkerName:  cr.Info.WorkerName,
+				CaseName:    cr.TestCase.Name,
+				StepName:    "_NONE_",
+				Success:     true,
+			}, w),
+			Value: SerializeTDigest(td),
+		})
+		delete(pausedMs, w)
+	}
+	return metrics
+}
@@ -12,6 +12,7 @@ const (
 	InnerVarWorkerTotal       = "__worker_total"
 	InnerVarWorkerIndex       = "__worker_index"
 	InnerVarWorkerConcurrency = "__worker_concurrency"
+	InnerVarTaskId            = "__task_id"
 )
 
 type IResultV1 interface {
@@ -133,6 +134,18 @@ func (r *Result) End() {
 	r.EndTime = time.Now().UnixMilli()
 }
 
+// ShiftTimes moves BeginTime and EndTime of the result and its sub-results by
+// ms milliseconds.
+func (r *Result) ShiftTimes(ms int64) {
+	r.BeginTime += ms
+	r.EndTime += ms
+	for _, sub := range r.SubResults {
+		if sr, ok := sub.(*Result); ok {
+			sr.ShiftTimes(ms)
+		}
+	}
+}
+
 func (r *Result) AddSub(name string, useNamePrefix bool) *Result {
 	if name == "" {
 		name = fmt.Sprintf("%s-%d", r.Name, r.subIndex)
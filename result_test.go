@@ -0,0 +1,24 @@
+package workerclient
+
+import "testing"
+
+func TestResultShiftTimes(t *testing.T) {
+	r := &Result{BeginTime: 1000, EndTime: 1500}
+	sub := r.AddSub("sub", false)
+	sub.BeginTime, sub.EndTime = 1100, 1200
+	r.SubResults = append(r.SubResults, "not a result")
+	tests := []struct {
+		ms                   int64
+		begin, end, subBegin int64
+	}{
+		{0, 1000, 1500, 1100},
+		{250, 1250, 1750, 1350},
+		{-500, 750, 1250, 850},
+	}
+	for _, tt := range tests {
+		r.ShiftTimes(tt.ms)
+		if r.BeginTime != tt.begin || r.EndTime != tt.end || sub.BeginTime != tt.subBegin || sub.EndTime-sub.BeginTime != 100 {
+			t.Fatalf("ShiftTimes(%v): result %v-%v, sub %v-%v", tt.ms, r.BeginTime, r.EndTime, sub.BeginTime, sub.EndTime)
+		}
+	}
+}
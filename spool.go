@@ -0,0 +1,395 @@
+package workerclient
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSpoolSegmentBytes is the size after which the spool starts a new
+// segment file.
+const DefaultSpoolSegmentBytes = 4 << 20
+
+const (
+	spoolSegmentPrefix = "segment-"
+	spoolSegmentSuffix = ".log"
+	spoolAckFile       = "ack"
+)
+
+type spoolRecord struct {
+	Seq     uint64            `json:"seq"`
+	Metrics []*CallTimeMetric `json:"metrics"`
+}
+
+type spoolSegment struct {
+	path     string
+	firstSeq uint64
+}
+
+// MetricsSpool keeps metric batches that have not been acknowledged by the
+// coordinator in append-only segment files, so they survive coordinator
+// outages and worker restarts. Every batch gets a sequence number, written to
+// CallTimeMetric.BatchSeq, that lets the coordinator drop replayed batches.
+type MetricsSpool struct {
+	Dir             string
+	SegmentMaxBytes int64
+	lock            sync.Mutex
+	segments        []*spoolSegment
+	active          *os.File
+	activeSize      int64
+	nextSeq         uint64
+	ackedSeq        uint64
+	readSeg         *spoolSegment // segment Peek continues in
+	readOffset      int64         // offset in readSeg of the first record Peek has not passed
+	corrupt         uint64
+	notify          chan struct{}
+}
+
+// OpenMetricsSpool opens the spool in dir, creating it if needed, and picks
+// up any batches left unacknowledged by a previous process.
+func OpenMetricsSpool(dir string) (*MetricsSpool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create spool dir: %w", err)
+	}
+	s := &MetricsSpool{
+		Dir:             dir,
+		SegmentMaxBytes: DefaultSpoolSegmentBytes,
+		notify:          make(chan struct{}, 1),
+	}
+
+	ack, err := os.ReadFile(filepath.Join(dir, spoolAckFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read spool ack: %w", err)
+	}
+	if len(ack) > 0 {
+		if s.ackedSeq, err = strconv.ParseUint(strings.TrimSpace(string(ack)), 10, 64); err != nil {
+			return nil, fmt.Errorf("failed to parse spool ack: %w", err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list spool dir: %w", err)
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, spoolSegmentPrefix) || !strings.HasSuffix(name, spoolSegmentSuffix) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, spoolSegmentPrefix), spoolSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, &spoolSegment{path: filepath.Join(dir, name), firstSeq: first})
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].firstSeq < s.segments[j].firstSeq })
+
+	// A crash right after a rotation leaves the last segment empty or torn,
+	// so the sequence numbers continue after the newest segment that holds a
+	// record, and never below the first sequence number of a later segment.
+	s.nextSeq = s.ackedSeq + 1
+	for i := len(s.segments) - 1; i >= 0; i-- {
+		seg := s.segments[i]
+		if seg.firstSeq > s.nextSeq {
+			s.nextSeq = seg.firstSeq
+		}
+		found := false
+		var end int64
+		err := scanSpoolSegment(seg.path, 0, func(rec *spoolRecord, e int64) bool {
+			if rec != nil {
+				found = true
+				if rec.Seq >= s.nextSeq {
+					s.nextSeq = rec.Seq + 1
+				}
+			}
+			end = e
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		if i == len(s.segments)-1 {
+			if err := trimSpoolSegment(seg.path, end); err != nil {
+				return nil, err
+			}
+		}
+		if found {
+			break
+		}
+	}
+	if err := s.removeAckedSegments(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// scanSpoolSegment calls fn for every complete record in the segment from
+// offset on, with the offset just past the record, until fn returns false. A
+// record that cannot be decoded is passed as nil. A torn record at the end of
+// the file is ignored.
+func scanSpoolSegment(path string, offset int64, fn func(rec *spoolRecord, end int64) bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open spool segment: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek spool segment: %w", err)
+	}
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read spool segment: %w", err)
+		}
+		offset += int64(len(line))
+		rec := &spoolRecord{}
+		if json.Unmarshal(line, rec) != nil {
+			rec = nil
+		}
+		if !fn(rec, offset) {
+			return nil
+		}
+	}
+}
+
+// trimSpoolSegment cuts a torn record off the end of the segment, so the next
+// append does not run into it.
+func trimSpoolSegment(path string, end int64) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat spool segment: %w", err)
+	}
+	if info.Size() <= end {
+		return nil
+	}
+	fmt.Printf("Dropping torn record at the end of spool segment %v\n", path)
+	if err := os.Truncate(path, end); err != nil {
+		return fmt.Errorf("failed to trim spool segment: %w", err)
+	}
+	return nil
+}
+
+// spoolSegmentPath returns the path of the segment starting at firstSeq.
+func spoolSegmentPath(dir string, firstSeq uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%v%020d%v", spoolSegmentPrefix, firstSeq, spoolSegmentSuffix))
+}
+
+// Append assigns the next sequence number to batch and persists it.
+func (s *MetricsSpool) Append(batch []*CallTimeMetric) (uint64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	seq := s.nextSeq
+	for _, m := range batch {
+		m.BatchSeq = seq
+	}
+	data, err := json.Marshal(&spoolRecord{Seq: seq, Metrics: batch})
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal spool record: %w", err)
+	}
+	data = append(data, '\n')
+
+	if s.active == nil || s.activeSize >= s.SegmentMaxBytes {
+		if err := s.rotate(seq); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := s.active.Write(data); err != nil {
+		return 0, fmt.Errorf("failed to write spool segment: %w", err)
+	}
+	if err := s.active.Sync(); err != nil {
+		return 0, fmt.Errorf("failed to sync spool segment: %w", err)
+	}
+	s.activeSize += int64(len(data))
+	s.nextSeq++
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return seq, nil
+}
+
+func (s *MetricsSpool) rotate(firstSeq uint64) error {
+	if s.active != nil {
+		s.active.Close()
+	}
+	path := spoolSegmentPath(s.Dir, firstSeq)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create spool segment: %w", err)
+	}
+	s.active = f
+	s.activeSize = 0
+	if n := len(s.segments); n == 0 || s.segments[n-1].path != path {
+		s.segments = append(s.segments, &spoolSegment{path: path, firstSeq: firstSeq})
+	}
+	return nil
+}
+
+// Peek returns the oldest unacknowledged batch, or ok == false if there is
+// none. It reads on from where the previous Peek stopped, so draining the
+// spool reads every record once. Corrupt records are skipped and counted.
+func (s *MetricsSpool) Peek() (seq uint64, batch []*CallTimeMetric, ok bool, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i := s.readIndex(); i < len(s.segments); i++ {
+		seg := s.segments[i]
+		if seg != s.readSeg {
+			s.readSeg, s.readOffset = seg, 0
+		}
+		err = scanSpoolSegment(seg.path, s.readOffset, func(rec *spoolRecord, end int64) bool {
+			if rec == nil {
+				s.corrupt++
+				fmt.Printf("Skipping corrupt record in spool segment %v at offset %v\n", seg.path, s.readOffset)
+			} else if rec.Seq > s.ackedSeq {
+				seq, batch, ok = rec.Seq, rec.Metrics, true
+				return false
+			}
+			s.readOffset = end
+			return true
+		})
+		if err != nil || ok {
+			return
+		}
+	}
+	return
+}
+
+// readIndex returns the index of the segment Peek continues in, starting over
+// at the first segment if that one was removed. The caller must hold the lock.
+func (s *MetricsSpool) readIndex() int {
+	for i, seg := range s.segments {
+		if seg == s.readSeg {
+			return i
+		}
+	}
+	s.readSeg, s.readOffset = nil, 0
+	return 0
+}
+
+// Corrupt returns how many records Peek skipped because they could not be
+// decoded.
+func (s *MetricsSpool) Corrupt() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.corrupt
+}
+
+// Ack marks every batch up to and including seq as delivered and removes
+// segments that no longer hold unacknowledged batches.
+func (s *MetricsSpool) Ack(seq uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if seq <= s.ackedSeq {
+		return nil
+	}
+	tmp := filepath.Join(s.Dir, spoolAckFile+".tmp")
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(seq, 10)), 0o644); err != nil {
+		return fmt.Errorf("failed to write spool ack: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(s.Dir, spoolAckFile)); err != nil {
+		return fmt.Errorf("failed to write spool ack: %w", err)
+	}
+	s.ackedSeq = seq
+	return s.removeAckedSegments()
+}
+
+// removeAckedSegments deletes every segment except the last one whose
+// batches are all acknowledged. The caller must hold the lock.
+func (s *MetricsSpool) removeAckedSegments() error {
+	for len(s.segments) > 1 && s.segments[1].firstSeq-1 <= s.ackedSeq {
+		if err := os.Remove(s.segments[0].path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove spool segment: %w", err)
+		}
+		s.segments = s.segments[1:]
+	}
+	return nil
+}
+
+// Pending returns how many batches are waiting for delivery.
+func (s *MetricsSpool) Pending() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.nextSeq - 1 - s.ackedSeq
+}
+
+// deliverOne sends the oldest unacknowledged batch and acknowledges it once
+// send succeeds.
+func (s *MetricsSpool) deliverOne(send func([]*CallTimeMetric) error) (delivered bool, err error) {
+	seq, batch, ok, err := s.Peek()
+	if err != nil || !ok {
+		return false, err
+	}
+	if err := send(batch); err != nil {
+		return false, err
+	}
+	return true, s.Ack(seq)
+}
+
+// Replay delivers spooled batches in order until ctx is done, waiting for new
+// batches when the spool is empty and backing off while send fails. It returns
+// as soon as ctx is done and leaves the rest of the spool to Flush.
+func (s *MetricsSpool) Replay(ctx context.Context, send func([]*CallTimeMetric) error, backoff Backoff) {
+	backoff = backoff.orDefault(DefaultMetricsBackoff())
+	failures := 0
+	for ctx.Err() == nil {
+		delivered, err := s.deliverOne(send)
+		var wait <-chan time.Time
+		if err != nil {
+			failures++
+			delay := backoff.Delay(failures)
+			fmt.Printf("Error replaying spooled metrics (attempt %v, retrying in %v): %v\n", failures, delay, err)
+			wait = time.After(delay)
+		} else if delivered {
+			failures = 0
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.notify:
+		case <-wait:
+		}
+	}
+}
+
+// Flush delivers spooled batches until the spool is empty, send fails or ctx
+// is done. Whatever is left stays on disk for the next process.
+func (s *MetricsSpool) Flush(ctx context.Context, send func([]*CallTimeMetric) error) error {
+	for ctx.Err() == nil {
+		delivered, err := s.deliverOne(send)
+		if err != nil || !delivered {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// Close closes the active segment file.
+func (s *MetricsSpool) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.active == nil {
+		return nil
+	}
+	err := s.active.Close()
+	s.active = nil
+	return err
+}
@@ -0,0 +1,236 @@
+package workerclient
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func spoolBatch(name string) []*CallTimeMetric {
+	return []*CallTimeMetric{{Key: CallTimeMapKey{MetricName: name}}}
+}
+
+func spoolSegmentCount(t *testing.T, dir string) int {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(dir, spoolSegmentPrefix+"*"+spoolSegmentSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(matches)
+}
+
+func TestMetricsSpoolAckAndRotate(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenMetricsSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every record fills a segment, so every append rotates.
+	s.SegmentMaxBytes = 1
+	for _, name := range []string{"a", "b", "c"} {
+		if _, err := s.Append(spoolBatch(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := spoolSegmentCount(t, dir); n != 3 {
+		t.Fatalf("%v segments, want 3", n)
+	}
+
+	tests := []struct {
+		wantSeq      uint64
+		wantName     string
+		wantPending  uint64
+		wantSegments int
+	}{
+		{1, "a", 2, 2},
+		{2, "b", 1, 1},
+		{3, "c", 0, 1}, // the last segment stays for appends
+	}
+	for _, tt := range tests {
+		seq, batch, ok, err := s.Peek()
+		if err != nil || !ok || seq != tt.wantSeq || batch[0].Key.MetricName != tt.wantName || batch[0].BatchSeq != tt.wantSeq {
+			t.Fatalf("Peek = %v %v %v %v, want seq %v", seq, batch, ok, err, tt.wantSeq)
+		}
+		if err := s.Ack(seq); err != nil {
+			t.Fatal(err)
+		}
+		if p := s.Pending(); p != tt.wantPending {
+			t.Errorf("after ack %v: Pending = %v, want %v", seq, p, tt.wantPending)
+		}
+		if n := spoolSegmentCount(t, dir); n != tt.wantSegments {
+			t.Errorf("after ack %v: %v segments, want %v", seq, n, tt.wantSegments)
+		}
+	}
+	if _, _, ok, _ := s.Peek(); ok {
+		t.Fatal("Peek found a batch in a drained spool")
+	}
+	// Acking an old sequence number again is a no-op.
+	if err := s.Ack(1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetricsSpoolReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenMetricsSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if _, err := s.Append(spoolBatch(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Ack(1); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = OpenMetricsSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if p := s.Pending(); p != 2 {
+		t.Fatalf("Pending = %v, want 2", p)
+	}
+	if seq, _, ok, _ := s.Peek(); !ok || seq != 2 {
+		t.Fatalf("Peek = %v %v, want seq 2", seq, ok)
+	}
+	if seq, err := s.Append(spoolBatch("d")); err != nil || seq != 4 {
+		t.Fatalf("Append = %v %v, want seq 4", seq, err)
+	}
+}
+
+func TestMetricsSpoolCorruptRecords(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenMetricsSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Append(spoolBatch("a")); err != nil {
+		t.Fatal(err)
+	}
+	// A corrupt record in the middle, then a good one, then a torn tail.
+	if _, err := s.active.WriteString("{not json\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Append(spoolBatch("b")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.active.WriteString(`{"seq":3,"metr`); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []uint64
+	for {
+		seq, _, ok, err := s.Peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		got = append(got, seq)
+		if err := s.Ack(seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Fatalf("delivered %v, want [1 2]", got)
+	}
+	if c := s.Corrupt(); c != 1 {
+		t.Fatalf("Corrupt = %v, want 1", c)
+	}
+}
+
+func TestMetricsSpoolReplayStopsOnCancel(t *testing.T) {
+	s, err := OpenMetricsSpool(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := s.Append(spoolBatch("a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sent := 0
+	s.Replay(ctx, func([]*CallTimeMetric) error {
+		sent++
+		if sent == 2 {
+			cancel()
+		}
+		return nil
+	}, Backoff{})
+	if sent != 2 || s.Pending() != 3 {
+		t.Fatalf("sent %v, %v pending; want 2 sent and 3 left for Flush", sent, s.Pending())
+	}
+
+	fail := errors.New("unreachable")
+	if err := s.Flush(context.Background(), func([]*CallTimeMetric) error { return fail }); !errors.Is(err, fail) {
+		t.Fatalf("Flush = %v, want %v", err, fail)
+	}
+	if err := s.Flush(context.Background(), func([]*CallTimeMetric) error { return nil }); err != nil || s.Pending() != 0 {
+		t.Fatalf("Flush = %v with %v pending", err, s.Pending())
+	}
+	if _, err := os.Stat(filepath.Join(s.Dir, spoolAckFile)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetricsSpoolReopenAfterCrashedRotate(t *testing.T) {
+	tests := []struct {
+		name string
+		tail string // content of the segment the crash left behind
+	}{
+		{"empty last segment", ""},
+		{"torn last segment", `{"seq":3,"metr`},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		s, err := OpenMetricsSpool(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.SegmentMaxBytes = 1
+		for _, name := range []string{"a", "b"} {
+			if _, err := s.Append(spoolBatch(name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s.Close()
+		if err := os.WriteFile(spoolSegmentPath(dir, 3), []byte(tt.tail), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		s, err = OpenMetricsSpool(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq, err := s.Append(spoolBatch("c")); err != nil || seq != 3 {
+			t.Fatalf("%v: Append = %v %v, want seq 3", tt.name, seq, err)
+		}
+		var got []string
+		for {
+			seq, batch, ok, err := s.Peek()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				break
+			}
+			got = append(got, batch[0].Key.MetricName)
+			if err := s.Ack(seq); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if strings.Join(got, "") != "abc" || s.Corrupt() != 0 {
+			t.Errorf("%v: delivered %v with %v corrupt records, want a, b, c", tt.name, got, s.Corrupt())
+		}
+		s.Close()
+	}
+}
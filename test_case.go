@@ -2,6 +2,7 @@ package workerclient
 
 import (
 	"fmt"
+	"strconv"
 	"time"
 )
 
@@ -12,6 +13,7 @@ func NewTestCase(caseName string) *TestCase {
 }
 
 type CaseParams struct {
+	TaskId          string
 	GlobalParams    map[string]string
 	CoroutineParams map[string]string
 	CaseRunnerInfo  CaseRunnerInfo
@@ -21,6 +23,9 @@ type TestCase struct {
 	Name      string
 	Teststeps []*TestStep
 	TearDown  func(coroutineParams map[string]string)
+	// OnGlobalParamsChanged is called once per update of the global params of
+	// a running case, one update at a time.
+	OnGlobalParamsChanged func(oldParams, newParams map[string]string)
 }
 
 type TestStep struct {
@@ -64,70 +69,118 @@ func (tc *TestCase) AddStep(ts *TestStep) {
 
 func (tc *TestCase) Run(globalParams, coroutineParams map[string]string, rpsQLimiter *RpsQLimiter, output *Output, caseRunner *CaseRunner) {
 	caseParams := &CaseParams{
+		TaskId:          caseRunner.Info.TaskId,
 		GlobalParams:    globalParams,
 		CoroutineParams: coroutineParams,
 		CaseRunnerInfo:  caseRunner.Info,
 	}
+	executorIndex, _ := strconv.Atoi(coroutineParams[InnerVarExecutorIndex])
 
 	for {
-		if !caseRunner.IsRunning {
+		caseRunner.waitForSlot(executorIndex)
+		if !caseRunner.IsRunning() || caseRunner.retireVU(executorIndex) {
 			break
 		}
-		for _, ts := range tc.Teststeps {
-			if !caseRunner.IsRunning {
-				break
-			}
-			reqParams := ts.GenReqParamsFunc(caseParams)
-			reqParams[InnerVarName] = ts.StepName
-			reqParams[InnerVarGoroutineId] = caseParams.CoroutineParams[InnerVarGoroutineId]
-			reqParams[InnerVarExecutorIndex] = caseParams.CoroutineParams[InnerVarExecutorIndex]
-			if !ts.ExecWhenFunc(caseParams, reqParams) {
-				continue
-			}
+		tc.runIteration(caseParams, rpsQLimiter, output, caseRunner)
+		time.Sleep(100 * time.Millisecond)
+	}
 
-			if rpsQLimiter.Limter.HasKey(ts.GetStepIndex()) {
-				ch := make(chan bool)
-				rpsQLimiter.Lock.Lock()
-				rpsQLimiter.QMap[ts.GetStepIndex()].Add(ch)
-				rpsQLimiter.Lock.Unlock()
-				<-ch
-			}
+	if tc.TearDown != nil {
+		tc.TearDown(coroutineParams)
+	}
+}
 
-			if !caseRunner.IsRunning {
-				break
-			}
+// runArrivals runs one iteration per arrival the VU takes from the case
+// runner of an arrival-rate case. With iterate it runs one before the first
+// arrival.
+func (tc *TestCase) runArrivals(globalParams, coroutineParams map[string]string, rpsQLimiter *RpsQLimiter, output *Output, caseRunner *CaseRunner, iterate bool) {
+	caseParams := &CaseParams{
+		TaskId:          caseRunner.Info.TaskId,
+		GlobalParams:    globalParams,
+		CoroutineParams: coroutineParams,
+		CaseRunnerInfo:  caseRunner.Info,
+	}
+	executorIndex, _ := strconv.Atoi(coroutineParams[InnerVarExecutorIndex])
+	// An idle VU wakes up now and then to see if it has been retired.
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
 
-			ts.PreFunc(caseParams, reqParams)
-			results := []IResultV1{}
-			res := ts.ReqPluginFunc(reqParams)
-			subResults := res.GetSubResults()
-			if len(subResults) == 0 {
-				results = append(results, res)
-			} else {
-				for _, sr := range subResults {
-					results = append(results, interface{}(sr).(IResultV1))
-				}
+	for {
+		if !iterate {
+			caseRunner.waitForSlot(executorIndex)
+			if !caseRunner.IsRunning() || caseRunner.retireVU(executorIndex) {
+				break
 			}
-
-			ok := true
-			for _, result := range results {
-				ts.PostFunc(caseParams, reqParams, result)
-				ok = result.IsSuccess() && ok
-				if output.ResChans != nil {
-					output.ResChans <- result
-				}
+			select {
+			case <-caseRunner.arrivals:
+			case <-caseRunner.stopCh:
+			case <-ticker.C:
+				continue
 			}
-			if !ok && !ts.ContinueWhenFailed {
+			if !caseRunner.IsRunning() {
 				break
 			}
-
-
 		}
-		time.Sleep(100 * time.Millisecond)
+		iterate = false
+		tc.runIteration(caseParams, rpsQLimiter, output, caseRunner)
 	}
 
 	if tc.TearDown != nil {
 		tc.TearDown(coroutineParams)
 	}
+}
+
+// runIteration runs the steps of the case once.
+func (tc *TestCase) runIteration(caseParams *CaseParams, rpsQLimiter *RpsQLimiter, output *Output, caseRunner *CaseRunner) {
+	// Every iteration sees one consistent version of the global params.
+	if snap := caseRunner.CurrentGlobalParams(); snap != nil {
+		caseParams.GlobalParams = snap.Params
+	}
+	for _, ts := range tc.Teststeps {
+		caseRunner.waitWhilePaused()
+		if !caseRunner.IsRunning() {
+			break
+		}
+		reqParams := ts.GenReqParamsFunc(caseParams)
+		reqParams[InnerVarName] = ts.StepName
+		reqParams[InnerVarGoroutineId] = caseParams.CoroutineParams[InnerVarGoroutineId]
+		reqParams[InnerVarExecutorIndex] = caseParams.CoroutineParams[InnerVarExecutorIndex]
+		reqParams[InnerVarTaskId] = caseParams.TaskId
+		if !ts.ExecWhenFunc(caseParams, reqParams) {
+			continue
+		}
+
+		waited, limited := rpsQLimiter.Wait(ts.GetStepIndex(), caseRunner.stopCh)
+
+		if !caseRunner.IsRunning() {
+			break
+		}
+
+		ts.PreFunc(caseParams, reqParams)
+		results := []IResultV1{}
+		res := ts.ReqPluginFunc(reqParams)
+		caseRunner.adjustResultClock(res)
+		subResults := res.GetSubResults()
+		if len(subResults) == 0 {
+			results = append(results, res)
+		} else {
+			for _, sr := range subResults {
+				results = append(results, interface{}(sr).(IResultV1))
+			}
+		}
 
+		ok := true
+		for i, result := range results {
+			ts.PostFunc(caseParams, reqParams, result)
+			ok = result.IsSuccess() && ok
+			if i == 0 && limited {
+				output.Send(&limiterWait{IResultV1: result, step: ts.StepName, wait: waited})
+			} else {
+				output.Send(result)
+			}
+		}
+		if !ok && !ts.ContinueWhenFailed {
+			break
+		}
+	}
 }
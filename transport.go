@@ -0,0 +1,63 @@
+package workerclient
+
+import (
+	"context"
+	"fmt"
+)
+
+// CoordinatorTransport carries all traffic between a worker and the
+// coordinator.
+type CoordinatorTransport interface {
+	// PushStatus reports the worker status and returns the coordinator's
+	// instructions.
+	PushStatus(ctx context.Context, params *WorkerPushStatusParams) (*RspWorkerPushStatus, error)
+	// SendMetrics delivers one metric batch and returns once the coordinator
+	// has accepted it.
+	SendMetrics(ctx context.Context, metrics []*CallTimeMetric) error
+	// ReceiveCommands passes commands pushed by the coordinator to handle
+	// until the connection breaks or ctx is done. mode is one of the
+	// CommandChannel constants; transports with a single push mechanism ignore
+	// it. connected reports whether a connection was established at all.
+	ReceiveCommands(ctx context.Context, mode string, baseInfo func() *WorkerBaseInfo, handle func(*RspWorkerPushStatus)) (connected bool, err error)
+	Close() error
+}
+
+// commandPusher is implemented by transports that push commands on their
+// own, so the worker receives them even without WorkerRunner.CommandChannel.
+type commandPusher interface {
+	pushesCommands() bool
+}
+
+// HTTPTransport is the JSON-over-HTTP coordinator protocol:
+// POST /worker/push_status, POST /worker/send_step_metrics and, for commands,
+// the /worker/command_channel WebSocket or POST /worker/wait_command.
+type HTTPTransport struct {
+	CoordinatorApi string
+	client         *HTTPClient
+}
+
+func NewHTTPTransport(coordinatorApi string, client *HTTPClient) *HTTPTransport {
+	return &HTTPTransport{
+		CoordinatorApi: coordinatorApi,
+		client:         client,
+	}
+}
+
+func (t *HTTPTransport) PushStatus(ctx context.Context, params *WorkerPushStatusParams) (*RspWorkerPushStatus, error) {
+	targetUrl := fmt.Sprintf("%v/worker/push_status", t.CoordinatorApi)
+	rsp := &RspWorkerPushStatusBody{}
+	if err := t.client.postJSON(ctx, targetUrl, t.client.opts.PushStatusTimeout, params, rsp); err != nil {
+		return nil, err
+	}
+	return rsp.Data, nil
+}
+
+func (t *HTTPTransport) SendMetrics(ctx context.Context, metrics []*CallTimeMetric) error {
+	targetUrl := fmt.Sprintf("%v/worker/send_step_metrics", t.CoordinatorApi)
+	return t.client.postJSON(ctx, targetUrl, t.client.opts.SendMetricsTimeout, metrics, nil)
+}
+
+func (t *HTTPTransport) Close() error {
+	t.client.client.CloseIdleConnections()
+	return nil
+}
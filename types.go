@@ -13,21 +13,68 @@ type RspWorkerPushStatusBody struct {
 }
 
 type RspWorkerPushStatus struct {
-	Worker         *Worker       `json:"worker"`
-	ShouldRunCase  bool          `json:"shouldRunCase"`
-	ShouldStopCase bool          `json:"shouldStopCase"`
-	TestCaseInfo   *TestCaseInfo `json:"testCase"`
+	Worker             *Worker                 `json:"worker"`
+	ShouldRunCase      bool                    `json:"shouldRunCase"`
+	ShouldStopCase     bool                    `json:"shouldStopCase"`
+	TestCaseInfo       *TestCaseInfo           `json:"testCase"`
+	SetConcurrency     *CaseConcurrencyCommand `json:"setConcurrency,omitempty"`
+	SetStepRps         []*StepRpsCommand       `json:"setStepRps,omitempty"`
+	UpdateGlobalParams *GlobalParamsCommand    `json:"updateGlobalParams,omitempty"`
+	PauseCase          *CaseCommand            `json:"pauseCase,omitempty"`
+	ResumeCase         *CaseCommand            `json:"resumeCase,omitempty"`
+	ServerTime         int64                   `json:"serverTime,omitempty"` // unix ms on the coordinator clock when it answered
+}
+
+// CaseCommand names a running case. An empty TaskId matches any run of the
+// case.
+type CaseCommand struct {
+	CaseName string `json:"caseName" binding:"required"`
+	TaskId   string `json:"taskId"`
+}
+
+// CaseConcurrencyCommand scales a running case to Concurrency VUs on this
+// worker. An empty TaskId matches any run of the case.
+type CaseConcurrencyCommand struct {
+	CaseName    string `json:"caseName" binding:"required"`
+	TaskId      string `json:"taskId"`
+	Concurrency uint64 `json:"concurrency"`
+}
+
+// StepRpsCommand changes the RPS limit of one step of a running case. Rps 0
+// removes the limit, Clear goes back to the step's RpsLimitFunc.
+type StepRpsCommand struct {
+	CaseName string `json:"caseName" binding:"required"`
+	TaskId   string `json:"taskId"`
+	StepName string `json:"stepName" binding:"required"`
+	Rps      uint64 `json:"rps"`
+	Clear    bool   `json:"clear"`
+}
+
+// GlobalParamsCommand replaces the global params of a running case. It is
+// ignored unless Version is newer than the version the case runs with.
+type GlobalParamsCommand struct {
+	CaseName     string            `json:"caseName" binding:"required"`
+	TaskId       string            `json:"taskId"`
+	Version      uint64            `json:"version"`
+	GlobalParams map[string]string `json:"globalParams" binding:"required"`
 }
 
 type CaseBaseInfo struct {
-	Name                 string            `json:"name" binding:"required"`
-	GlobalParams         map[string]string `json:"globalParams" binding:"required"`
-	TotalMaxConcurrency  uint64            `json:"totalMaxConcurrency" binding:"required"`
-	RampingSeconds       uint64            `json:"rampingSeconds" binding:"required"`
-	DurationMinutes      uint64            `json:"durationMinutes"  binding:"required"`
-	WorkName             string            `json:"workName" binding:"required"`
-	WorkerConcurrency     uint64            `json:"workerConcurrency" binding:"required"`
-	TaskId               string            `json:"taskId"`
+	Name                string               `json:"name" binding:"required"`
+	GlobalParams        map[string]string    `json:"globalParams" binding:"required"`
+	GlobalParamsVersion uint64               `json:"globalParamsVersion"`
+	LoadProfile         *LoadProfile         `json:"loadProfile,omitempty"`         // replaces the linear ramp to TotalMaxConcurrency
+	Executor            string               `json:"executor,omitempty"`            // ExecutorClosed (default) or ExecutorArrivalRate
+	ArrivalRate         *ArrivalRate         `json:"arrivalRate,omitempty"`         // required by ExecutorArrivalRate
+	ArrivalDistribution *ArrivalDistribution `json:"arrivalDistribution,omitempty"` // gaps between iterations and rate-limited steps
+	TotalMaxConcurrency uint64               `json:"totalMaxConcurrency" binding:"required"`
+	RampingSeconds      uint64               `json:"rampingSeconds" binding:"required"`
+	RampDownSeconds     uint64               `json:"rampDownSeconds"`               // retire the VUs over this long when the case is stopped
+	MetricWindowSeconds uint64               `json:"metricWindowSeconds,omitempty"` // one of MetricWindows; 0 and 60 keep minute windows
+	DurationMinutes     uint64               `json:"durationMinutes"  binding:"required"`
+	WorkName            string               `json:"workName" binding:"required"`
+	WorkerConcurrency   uint64               `json:"workerConcurrency" binding:"required"`
+	TaskId              string               `json:"taskId"`
 }
 
 type TestCaseInfo struct {
@@ -39,6 +86,7 @@ type TestCaseInfo struct {
 	BeginTime          uint64        `json:"beginTime"`
 	LastTime           uint64        `json:"lastTime"`
 	Summary            *CaseSummary  `json:"summary" binding:"optional"`
+	StartAt            int64         `json:"startAt,omitempty"` // unix ms on the coordinator clock at which every worker starts ramping
 }
 
 type CaseSummary struct {
@@ -58,10 +106,15 @@ type CallMonitor struct {
 }
 
 type TestCaseSummary struct {
-	Name                   string `json:"name" binding:"required"`
-	Status                 string `json:"status" binding:"required"`
-	ActiveConcurrencyCount int64  `json:"activeConcurrencyCount"`
-	TaskId                 string `json:"taskId"`
+	Name                   string            `json:"name" binding:"required"`
+	Status                 string            `json:"status" binding:"required"`
+	ActiveConcurrencyCount int64             `json:"activeConcurrencyCount"`
+	TargetConcurrency      uint64            `json:"targetConcurrency"` // VUs the running case is scaled to
+	TaskId                 string            `json:"taskId"`
+	StopReason             string            `json:"stopReason,omitempty"`    // why the last run of this case stopped
+	StepRpsLimits          map[string]uint64 `json:"stepRpsLimits,omitempty"` // current limit of every limited step
+	GlobalParamsVersion    uint64            `json:"globalParamsVersion"`     // version of the global params the case runs with
+	DroppedIterations      int64             `json:"droppedIterations"`       // arrival-rate iterations no VU was free for
 }
 
 type Worker struct {
@@ -75,6 +128,28 @@ type WorkerBaseInfo struct {
 	Index     int64              `json:"index"`
 	Status    string             `json:"status" binding:"required"`
 	TestCases []*TestCaseSummary `json:"testCases"`
+	// Clock offset measured from push_status round trips, see ClockOffset.
+	ClockOffsetMs int64 `json:"clockOffsetMs"` // coordinator clock minus worker clock
+	ClockRttMs    int64 `json:"clockRttMs"`    // round trip the offset was measured with
+	ClockSynced   bool  `json:"clockSynced"`   // false until the offset has been measured
+}
+
+// clone returns a deep copy of the worker info, so it can be encoded while
+// the original is updated.
+func (bi *WorkerBaseInfo) clone() *WorkerBaseInfo {
+	c := *bi
+	c.TestCases = make([]*TestCaseSummary, len(bi.TestCases))
+	for i, tc := range bi.TestCases {
+		summary := *tc
+		if tc.StepRpsLimits != nil {
+			summary.StepRpsLimits = make(map[string]uint64, len(tc.StepRpsLimits))
+			for step, rps := range tc.StepRpsLimits {
+				summary.StepRpsLimits[step] = rps
+			}
+		}
+		c.TestCases[i] = &summary
+	}
+	return &c
 }
 
 type WorkerPushStatusParams struct {
@@ -90,10 +165,13 @@ type CallTimeMapKey struct {
 	StepName    string `json:"stepName"`
 	Success     bool   `json:"success"`
 	StatusCode  int    `json:"statusCode"`
-	Ts          int    `json:"ts"`
+	Ts          int64  `json:"ts"`                 // unix minute of the window, or its start in unix ms when WindowMs is set
+	WindowMs    int    `json:"windowMs,omitempty"` // window length, set when the case has a metricWindowSeconds
 }
 
 type CallTimeMetric struct {
-	Key   CallTimeMapKey `json:"key"`
-	Value []TDNode       `json:"value"`
+	Key           CallTimeMapKey `json:"key"`
+	Value         []TDNode       `json:"value"`
+	BatchSeq      uint64         `json:"batchSeq,omitempty"`      // set when the batch went through a MetricsSpool, unique per spool
+	ClockOffsetMs int64          `json:"clockOffsetMs,omitempty"` // skew of the worker clock that Key.Ts was corrected by
 }
@@ -2,11 +2,18 @@ package workerclient
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/caio/go-tdigest/v4"
@@ -37,35 +44,211 @@ func UnserializeTDigest(nodes []TDNode) *tdigest.TDigest {
 	return td
 }
 
+// Backoff describes a jittered delay between calls to the coordinator that
+// grows exponentially while the calls keep failing. Unset fields fall back to
+// DefaultPollBackoff or DefaultMetricsBackoff.
+type Backoff struct {
+	Interval    time.Duration // delay after a successful call
+	MaxInterval time.Duration // upper bound for the delay after failures
+	Multiplier  float64       // growth factor per consecutive failure, at least 1
+	Jitter      float64       // random spread as a fraction of the delay, 0.2 means ±20%; 0 disables it unless the whole Backoff is unset
+}
+
+func DefaultPollBackoff() Backoff {
+	return Backoff{
+		Interval:    6 * time.Second,
+		MaxInterval: time.Minute,
+		Multiplier:  2,
+		Jitter:      0.2,
+	}
+}
+
+func DefaultMetricsBackoff() Backoff {
+	return Backoff{
+		Interval:    time.Second,
+		MaxInterval: 30 * time.Second,
+		Multiplier:  2,
+		Jitter:      0.2,
+	}
+}
+
+// orDefault fills the fields of b that are not set from def, so a zero or
+// partly set Backoff never retries in a hot loop.
+func (b Backoff) orDefault(def Backoff) Backoff {
+	if b == (Backoff{}) {
+		return def
+	}
+	if b.Interval <= 0 {
+		b.Interval = def.Interval
+	}
+	if b.MaxInterval <= 0 {
+		b.MaxInterval = def.MaxInterval
+	}
+	if b.MaxInterval < b.Interval {
+		b.MaxInterval = b.Interval
+	}
+	if b.Multiplier < 1 {
+		b.Multiplier = def.Multiplier
+	}
+	return b
+}
+
+var (
+	jitterLock sync.Mutex
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// Delay returns how long to wait after the given number of consecutive
+// failures.
+func (b Backoff) Delay(failures int) time.Duration {
+	d := float64(b.Interval)
+	for i := 0; i < failures && d < float64(b.MaxInterval); i++ {
+		d *= b.Multiplier
+	}
+	if b.MaxInterval > 0 && d > float64(b.MaxInterval) {
+		d = float64(b.MaxInterval)
+	}
+	if b.Jitter > 0 {
+		jitterLock.Lock()
+		d += d * b.Jitter * (2*jitterRand.Float64() - 1)
+		jitterLock.Unlock()
+	}
+	return time.Duration(d)
+}
+
+// TransportOptions configures the connection to the coordinator.
+type TransportOptions struct {
+	CAFile               string        // PEM bundle used instead of the system roots
+	CAPEM                []byte        // PEM bundle, trusted together with CAFile
+	CertFile             string        // client certificate for mutual TLS
+	KeyFile              string        // client key for mutual TLS
+	ServerName           string        // overrides the TLS server name taken from the coordinator URL
+	ProxyURL             string        // HTTP proxy for coordinator calls
+	ProxyFromEnvironment bool          // use HTTP_PROXY/HTTPS_PROXY/NO_PROXY when ProxyURL is empty
+	DisableKeepAlives    bool          // open a new connection for every call
+	MaxIdleConns         int           // idle connections kept open, default 4
+	IdleConnTimeout      time.Duration // default 90s
+	Timeout              time.Duration // default per-call timeout, 5s if zero
+	PushStatusTimeout    time.Duration // overrides Timeout for push_status
+	SendMetricsTimeout   time.Duration // overrides Timeout for send_step_metrics
+	InsecureSkipVerify   bool          // accept any server certificate, for test setups only
+}
+
 type HTTPClient struct {
 	client *http.Client
+	auth   Authenticator
+	opts   TransportOptions
 }
 
+// NewHTTPClient returns a client that verifies the coordinator certificate
+// against the system roots and reuses connections.
 func NewHTTPClient(timeout time.Duration) *HTTPClient {
+	c, _ := NewHTTPClientWithOptions(TransportOptions{Timeout: timeout})
+	return c
+}
+
+func NewHTTPClientWithOptions(opts TransportOptions) (*HTTPClient, error) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if opts.MaxIdleConns <= 0 {
+		opts.MaxIdleConns = 4
+	}
+	if opts.IdleConnTimeout <= 0 {
+		opts.IdleConnTimeout = 90 * time.Second
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         opts.ServerName,
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+	}
+	if opts.CAFile != "" || len(opts.CAPEM) > 0 {
+		pool := x509.NewCertPool()
+		pem := append([]byte{}, opts.CAPEM...)
+		if opts.CAFile != "" {
+			data, err := os.ReadFile(opts.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+			}
+			pem = append(pem, '\n')
+			pem = append(pem, data...)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in CA bundle")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
 	tr := &http.Transport{
-		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
-		DisableKeepAlives: true,
+		TLSClientConfig:     tlsConfig,
+		DisableKeepAlives:   opts.DisableKeepAlives,
+		MaxIdleConns:        opts.MaxIdleConns,
+		MaxIdleConnsPerHost: opts.MaxIdleConns,
+		IdleConnTimeout:     opts.IdleConnTimeout,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	if opts.ProxyURL != "" {
+		proxy, err := url.Parse(opts.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url: %w", err)
+		}
+		tr.Proxy = http.ProxyURL(proxy)
+	} else if opts.ProxyFromEnvironment {
+		tr.Proxy = http.ProxyFromEnvironment
 	}
 
 	return &HTTPClient{
 		client: &http.Client{
 			Transport: tr,
-			Timeout:   timeout,
 		},
-	}
+		opts: opts,
+	}, nil
+}
+
+// SetAuthenticator makes every request carry the credentials added by auth.
+func (c *HTTPClient) SetAuthenticator(auth Authenticator) {
+	c.auth = auth
 }
 
 func (c *HTTPClient) PostJSON(url string, requestBody interface{}, responseBody interface{}) error {
+	return c.PostJSONTimeout(url, 0, requestBody, responseBody)
+}
+
+// PostJSONTimeout is PostJSON with a per-call timeout; zero uses the client
+// default.
+func (c *HTTPClient) PostJSONTimeout(url string, timeout time.Duration, requestBody interface{}, responseBody interface{}) error {
+	return c.postJSON(context.Background(), url, timeout, requestBody, responseBody)
+}
+
+func (c *HTTPClient) postJSON(ctx context.Context, url string, timeout time.Duration, requestBody interface{}, responseBody interface{}) error {
 	jsonData, err := json.Marshal(requestBody)
 	if err != nil {
 		return fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	if timeout <= 0 {
+		timeout = c.opts.Timeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
+	if c.auth != nil {
+		if err := c.auth.Authenticate(req, jsonData); err != nil {
+			return fmt.Errorf("failed to authenticate request: %w", err)
+		}
+	}
 
 	resp, err := c.client.Do(req)
 	if err != nil {
@@ -78,6 +261,15 @@ func (c *HTTPClient) PostJSON(url string, requestBody interface{}, responseBody
 		return fmt.Errorf("failed to read response: %w", err)
 	}
 
+	if resp.StatusCode == http.StatusUnauthorized {
+		if inv, ok := c.auth.(invalidator); ok {
+			inv.Invalidate()
+		}
+	}
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("coordinator returned status %v", resp.StatusCode)
+	}
+
 	if responseBody != nil {
 		if err := json.Unmarshal(respBytes, responseBody); err != nil {
 			return fmt.Errorf("failed to unmarshal response: %w", err)
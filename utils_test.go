@@ -0,0 +1,59 @@
+package workerclient
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{Interval: time.Second, MaxInterval: 10 * time.Second, Multiplier: 2}
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{3, 8 * time.Second},
+		{4, 10 * time.Second},
+		{100, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := b.Delay(tt.failures); got != tt.want {
+			t.Errorf("Delay(%v) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestBackoffDelayJitter(t *testing.T) {
+	b := Backoff{Interval: time.Second, MaxInterval: time.Second, Multiplier: 2, Jitter: 0.2}
+	for i := 0; i < 100; i++ {
+		if d := b.Delay(3); d < 800*time.Millisecond || d > 1200*time.Millisecond {
+			t.Fatalf("Delay(3) = %v, want within ±20%% of 1s", d)
+		}
+	}
+}
+
+func TestBackoffOrDefault(t *testing.T) {
+	def := DefaultPollBackoff()
+	tests := []struct {
+		name string
+		in   Backoff
+		want Backoff
+	}{
+		{"zero", Backoff{}, def},
+		{"only interval", Backoff{Interval: 2 * time.Second}, Backoff{Interval: 2 * time.Second, MaxInterval: def.MaxInterval, Multiplier: def.Multiplier}},
+		{"max below interval", Backoff{Interval: 2 * time.Minute, Multiplier: 3}, Backoff{Interval: 2 * time.Minute, MaxInterval: 2 * time.Minute, Multiplier: 3}},
+		{"shrinking multiplier", Backoff{Interval: time.Second, MaxInterval: time.Minute, Multiplier: 0.5, Jitter: 0.1}, Backoff{Interval: time.Second, MaxInterval: time.Minute, Multiplier: def.Multiplier, Jitter: 0.1}},
+		{"complete", Backoff{Interval: time.Second, MaxInterval: time.Minute, Multiplier: 1}, Backoff{Interval: time.Second, MaxInterval: time.Minute, Multiplier: 1}},
+	}
+	for _, tt := range tests {
+		got := tt.in.orDefault(def)
+		if got != tt.want {
+			t.Errorf("%v: orDefault = %+v, want %+v", tt.name, got, tt.want)
+		}
+		if d := got.Delay(0); d <= 0 {
+			t.Errorf("%v: Delay(0) = %v, want a positive delay", tt.name, d)
+		}
+	}
+}
@@ -1,7 +1,10 @@
 package workerclient
 
 import (
+	"context"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -9,21 +12,180 @@ import (
 
 type CaseGenFunc func(caseRunnerInfo CaseRunnerInfo) *TestCase
 
+// Actions a HeartbeatLossPolicy can take on the running cases.
+const (
+	HeartbeatLossStop   = "stop"
+	HeartbeatLossReduce = "reduce"
+)
+
+// HeartbeatLossPolicy decides what happens to the running cases when the
+// coordinator cannot be reached. The policy triggers once either limit is hit.
+type HeartbeatLossPolicy struct {
+	MaxFailures               int           // consecutive failed push_status calls, 0 disables
+	MaxSilence                time.Duration // time since the last successful push_status, 0 disables
+	Action                    string        // HeartbeatLossStop or HeartbeatLossReduce
+	ReducedConcurrencyPercent uint64        // share of the worker's VUs kept running by HeartbeatLossReduce, 0 means DefaultReducedConcurrencyPercent
+	ResumeOnContact           bool          // restore full concurrency once push_status succeeds again
+}
+
+// DefaultReducedConcurrencyPercent is the share of VUs HeartbeatLossReduce
+// keeps running when the policy sets none.
+const DefaultReducedConcurrencyPercent = 50
+
+// reducedConcurrency returns how many of concurrency VUs HeartbeatLossReduce
+// keeps running. It keeps at least one, so a reduction never pauses the case.
+func (p *HeartbeatLossPolicy) reducedConcurrency(concurrency uint64) uint64 {
+	percent := p.ReducedConcurrencyPercent
+	if percent == 0 {
+		percent = DefaultReducedConcurrencyPercent
+	} else if percent > 100 {
+		percent = 100
+	}
+	n := concurrency * percent / 100
+	if n == 0 && concurrency > 0 {
+		n = 1
+	}
+	return n
+}
+
+// WorkerOption configures a WorkerRunner in NewWorkerRunner.
+type WorkerOption func(rw *WorkerRunner)
+
+// WithAuthenticator authenticates every request to the coordinator with auth,
+// see BearerToken, TokenRefresher and HMACSigner.
+func WithAuthenticator(auth Authenticator) WorkerOption {
+	return func(rw *WorkerRunner) {
+		rw.httpClient.SetAuthenticator(auth)
+		rw.httpOptions = true
+	}
+}
+
+// WithTransportOptions configures TLS, proxy, connection reuse and timeouts
+// for coordinator calls. It returns an error if the certificates cannot be
+// loaded or the options are invalid.
+func WithTransportOptions(opts TransportOptions) (WorkerOption, error) {
+	c, err := NewHTTPClientWithOptions(opts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transport options: %w", err)
+	}
+	return WithHTTPClient(c), nil
+}
+
+// WithHTTPClient makes the worker talk to the coordinator through c. An
+// authenticator set by an earlier option is kept unless c has its own.
+// It has no effect together with WithCoordinatorTransport.
+func WithHTTPClient(c *HTTPClient) WorkerOption {
+	return func(rw *WorkerRunner) {
+		if c.auth == nil {
+			c.auth = rw.httpClient.auth
+		}
+		rw.httpClient = c
+		rw.httpOptions = true
+	}
+}
+
+// WithCoordinatorTransport replaces the JSON-over-HTTP protocol, e.g. with a
+// GRPCTransport. WithAuthenticator, WithHTTPClient and WithTransportOptions
+// do not apply to t; configure authentication and TLS on t itself.
+func WithCoordinatorTransport(t CoordinatorTransport) WorkerOption {
+	return func(rw *WorkerRunner) {
+		rw.transport = t
+	}
+}
+
 type WorkerRunner struct {
 	Worker            *Worker
 	CoordinatorApi    string
 	CaseMaps          map[string]*TestCase
-	RunningCaseRunner *CaseRunner
+	CaseRunners       map[string]*CaseRunner // running cases keyed by case name
+	DrainTimeout      time.Duration          // overrides DefaultDrainTimeout when > 0
+	HeartbeatLoss     *HeartbeatLossPolicy   // nil keeps the cases running while the coordinator is unreachable
+	PollBackoff       Backoff                // push_status interval, backs off while the coordinator is unreachable
+	MetricsBackoff    Backoff                // retry delay for undelivered metric batches
+	MetricsBufferSize int                    // undelivered metric batches kept in memory per case, DefaultMetricsBufferSize if <= 0
+	MetricsSpool      *MetricsSpool          // optional on-disk buffer for metric batches, replayed by Run
+	CommandChannel    string                 // CommandChannelWebSocket or CommandChannelLongPoll to receive commands without waiting for the next poll
 	httpClient        *HTTPClient
+	transport         CoordinatorTransport
+	httpOptions       bool // an option configured httpClient
+	lock              sync.Mutex
+	failedPushes      int
+	lastContact       time.Time
+	degraded          bool
+	clock             clockEstimator
 }
 
-func (rw *WorkerRunner) Run() {
+// Run polls the coordinator until ctx is cancelled, then stops the running
+// cases, waits for them to drain and reports the worker as offline.
+func (rw *WorkerRunner) Run(ctx context.Context) error {
+	rw.lock.Lock()
+	rw.lastContact = time.Now()
+	rw.lock.Unlock()
+	var wg sync.WaitGroup
+	if rw.MetricsSpool != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rw.MetricsSpool.Replay(ctx, rw.sendStepMetrics, rw.MetricsBackoff)
+		}()
+	}
+	if _, pushes := rw.transport.(commandPusher); pushes || rw.CommandChannel != CommandChannelNone {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rw.runCommandChannel(ctx)
+		}()
+	}
 	for {
 		rw.RealRun()
-		time.Sleep(time.Second * 6)
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return rw.Shutdown()
+		case <-time.After(rw.pollDelay()):
+		}
 	}
 }
 
+// Shutdown stops the running cases, waits up to DrainTimeout for every VU to
+// finish its TearDown and for the last metrics batch to be delivered, then
+// pushes an "offline" status to the coordinator and closes the transport and
+// the MetricsSpool.
+func (rw *WorkerRunner) Shutdown() error {
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+	var wg sync.WaitGroup
+	for _, cr := range rw.CaseRunners {
+		wg.Add(1)
+		go func(cr *CaseRunner) {
+			defer wg.Done()
+			cr.Stop(StopReasonLocalAbort)
+		}(cr)
+	}
+	wg.Wait()
+	if rw.MetricsSpool != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), rw.drainTimeout())
+		if err := rw.MetricsSpool.Flush(ctx, rw.sendStepMetrics); err != nil {
+			fmt.Printf("%v spooled metric batches left for the next start: %v\n", rw.MetricsSpool.Pending(), err)
+		}
+		cancel()
+	}
+	rw.Worker.BaseInfo.Status = "offline"
+	_, pushErr := rw.pushStatus()
+	if rw.MetricsSpool != nil {
+		if err := rw.MetricsSpool.Close(); err != nil {
+			fmt.Printf("Failed to close the metrics spool: %v\n", err)
+		}
+	}
+	if err := rw.transport.Close(); err != nil {
+		fmt.Printf("Failed to close the coordinator transport: %v\n", err)
+	}
+	if pushErr != nil {
+		return fmt.Errorf("failed to push offline status: %w", pushErr)
+	}
+	return nil
+}
+
 func (rw *WorkerRunner) RealRun() {
 	defer func() {
 		if p := recover(); p != nil {
@@ -31,63 +193,208 @@ func (rw *WorkerRunner) RealRun() {
 		}
 	}()
 
+	// The push runs outside rw.lock, so commands from the command channel
+	// are not held up by a slow coordinator.
 	rspWPS := rw.PushStatus()
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+	rw.handleCommand(rspWPS)
+}
+
+// pollDelay returns how long Run waits before the next push_status.
+func (rw *WorkerRunner) pollDelay() time.Duration {
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+	return rw.PollBackoff.orDefault(DefaultPollBackoff()).Delay(rw.failedPushes)
+}
+
+// handleCommand applies a push_status response or a command received on the
+// command channel. The caller must hold rw.lock.
+func (rw *WorkerRunner) handleCommand(rspWPS *RspWorkerPushStatus) {
 	if rspWPS == nil {
 		return
 	}
-	rw.Worker.BaseInfo.Index = rspWPS.Worker.BaseInfo.Index
+	if rspWPS.Worker != nil {
+		rw.Worker.BaseInfo.Index = rspWPS.Worker.BaseInfo.Index
+	}
+	if cmd := rspWPS.SetConcurrency; cmd != nil {
+		if cr := rw.runningCase(cmd.CaseName, cmd.TaskId); cr != nil {
+			from := cr.Concurrency()
+			if err := cr.SetConcurrency(cmd.Concurrency); err != nil {
+				fmt.Printf("Failed to scale case %v: %v\n", cmd.CaseName, err)
+			} else {
+				fmt.Printf("Scaling case %v from %v to %v VUs\n", cmd.CaseName, from, cmd.Concurrency)
+			}
+		}
+	}
+	if cmd := rspWPS.UpdateGlobalParams; cmd != nil {
+		if cr := rw.runningCase(cmd.CaseName, cmd.TaskId); cr != nil {
+			// OnGlobalParamsChanged is test code, keep it out of rw.lock. A
+			// version that lands after a newer one is rejected.
+			go func() {
+				if cr.UpdateGlobalParams(cmd.Version, cmd.GlobalParams) {
+					fmt.Printf("Updated global params of case %v to version %v\n", cmd.CaseName, cmd.Version)
+				}
+			}()
+		}
+	}
+	refreshRps := map[*CaseRunner]bool{}
+	for _, cmd := range rspWPS.SetStepRps {
+		cr := rw.runningCase(cmd.CaseName, cmd.TaskId)
+		if cr == nil {
+			continue
+		}
+		if err := cr.overrideStepRps(cmd.StepName, cmd.Rps, cmd.Clear); err != nil {
+			fmt.Printf("Failed to change RPS of case %v: %v\n", cmd.CaseName, err)
+			continue
+		}
+		refreshRps[cr] = true
+	}
+	for cr := range refreshRps {
+		// The new limits may call RpsLimitFunc, which is test code, so they
+		// are applied outside rw.lock.
+		go func(cr *CaseRunner) {
+			if err := cr.refreshStepRps(); err != nil {
+				fmt.Printf("Failed to change RPS of case %v: %v\n", cr.TestCase.Name, err)
+			}
+		}(cr)
+	}
+	if cmd := rspWPS.PauseCase; cmd != nil {
+		if cr := rw.runningCase(cmd.CaseName, cmd.TaskId); cr != nil {
+			if err := cr.Pause(); err != nil {
+				fmt.Printf("Failed to pause case %v: %v\n", cmd.CaseName, err)
+			}
+		}
+	}
+	if cmd := rspWPS.ResumeCase; cmd != nil {
+		if cr := rw.runningCase(cmd.CaseName, cmd.TaskId); cr != nil {
+			if err := cr.Resume(); err != nil {
+				fmt.Printf("Failed to resume case %v: %v\n", cmd.CaseName, err)
+			}
+		}
+	}
 	if rspWPS.ShouldRunCase {
 		tc := rw.CaseMaps[rspWPS.TestCaseInfo.BaseInfo.Name]
 		if tc == nil {
 			return
 		}
 		baseInfo := rspWPS.TestCaseInfo.BaseInfo
-		rmc := int64(baseInfo.TotalMaxConcurrency)
-		workerConc := int64(baseInfo.WorkerConcurrency)
+		if cr := rw.CaseRunners[tc.Name]; cr != nil {
+			if cr.Info.TaskId == baseInfo.TaskId {
+				// A retried start for the run we already have.
+				return
+			}
+			if !cr.Done() {
+				fmt.Printf("Rejecting start of case %v task %v: task %v is %v\n", tc.Name, baseInfo.TaskId, cr.Info.TaskId, cr.State())
+				return
+			}
+		}
 		widx := rw.Worker.BaseInfo.Index
 
 		// Calculate the concurrency that the current worker should use
-		var currentWorkerConcurrency uint64
-		remaining := rmc - workerConc*widx
-
-		if remaining <= 0 {
+		peak := baseInfo.TotalMaxConcurrency
+		if baseInfo.LoadProfile != nil && len(baseInfo.LoadProfile.Stages) > 0 {
+			peak = baseInfo.LoadProfile.MaxTarget()
+		}
+		currentWorkerConcurrency := workerShare(peak, baseInfo.WorkerConcurrency, widx)
+		if baseInfo.Executor == ExecutorArrivalRate {
+			if baseInfo.ArrivalRate == nil {
+				fmt.Printf("Rejecting start of case %v task %v: executor %v without arrivalRate\n", tc.Name, baseInfo.TaskId, baseInfo.Executor)
+				return
+			}
+			// Every worker starts its part of the rate from its own VU pool.
+			currentWorkerConcurrency = baseInfo.ArrivalRate.PoolSize()
+			if currentWorkerConcurrency == 0 {
+				fmt.Printf("Rejecting start of case %v task %v: arrivalRate needs preAllocatedVUs or maxVUs\n", tc.Name, baseInfo.TaskId)
+				return
+			}
+		}
+		if currentWorkerConcurrency == 0 {
 			return
 		}
-		if remaining < workerConc {
-			currentWorkerConcurrency = uint64(remaining)
-		} else {
-			currentWorkerConcurrency = uint64(workerConc)
+		if !validMetricWindow(baseInfo.MetricWindowSeconds) {
+			fmt.Printf("Rejecting start of case %v task %v: metric window of %vs is not one of %v\n", tc.Name, baseInfo.TaskId, baseInfo.MetricWindowSeconds, MetricWindows)
+			return
+		}
+		var startAt time.Time
+		if rspWPS.TestCaseInfo.StartAt > 0 {
+			startAt = rw.coordinatorTime(rspWPS.TestCaseInfo.StartAt)
+			if d := time.Until(startAt); d > MaxStartDelay {
+				fmt.Printf("Rejecting start of case %v task %v: start time is %v ahead, more than %v\n", tc.Name, baseInfo.TaskId, d.Round(time.Second), MaxStartDelay)
+				return
+			}
 		}
 		rw.Worker.BaseInfo.Status = "running"
 		caseRunnerInfo := CaseRunnerInfo{
+			TaskId:                    baseInfo.TaskId,
 			WorkerName:                rw.Worker.BaseInfo.Name,
 			MaxConcurrencyInThisWoker: currentWorkerConcurrency,
 			RampingSeconds:            baseInfo.RampingSeconds,
+			RampDownSeconds:           baseInfo.RampDownSeconds,
+			MetricWindowSeconds:       baseInfo.MetricWindowSeconds,
 			DurationMinutes:           baseInfo.DurationMinutes,
 			WorkerTotal:               rspWPS.TestCaseInfo.WorkerTotal,
 			WorkerIndex:               uint64(widx),
 			WorkerConcurrency:         baseInfo.WorkerConcurrency,
+			LoadProfile:               baseInfo.LoadProfile,
+			Executor:                  baseInfo.Executor,
+			ArrivalRate:               baseInfo.ArrivalRate,
+			ArrivalDistribution:       baseInfo.ArrivalDistribution,
+			StartAt:                   startAt,
 		}
-		rw.RunningCaseRunner = &CaseRunner{
-			Info:           caseRunnerInfo,
-			TestCase:       tc,
-			CoordinatorApi: rw.CoordinatorApi,
-			httpClient:     rw.httpClient,
-		}
-		rw.RunningCaseRunner.SetGlobalParams(rspWPS.TestCaseInfo.BaseInfo.GlobalParams)
+		cr := NewCaseRunner(caseRunnerInfo, tc, rw.transport)
+		cr.CoordinatorApi = rw.CoordinatorApi
+		cr.clock = &rw.clock
+		cr.DrainTimeout = rw.drainTimeout()
+		cr.MetricsBackoff = rw.MetricsBackoff
+		cr.MetricsBufferSize = rw.MetricsBufferSize
+		cr.MetricsSpool = rw.MetricsSpool
+		cr.UpdateGlobalParams(baseInfo.GlobalParamsVersion, baseInfo.GlobalParams)
+		rw.CaseRunners[tc.Name] = cr
 		go func() {
-			rw.RunningCaseRunner.Run()
+			cr.Run()
 		}()
 		return
 	}
 
 	if rspWPS.ShouldStopCase {
-		if rw.RunningCaseRunner != nil {
-			rw.RunningCaseRunner.StopRunChannel()
+		// A stop without a case stops every running case.
+		stopName := ""
+		if rspWPS.TestCaseInfo != nil && rspWPS.TestCaseInfo.BaseInfo != nil {
+			stopName = rspWPS.TestCaseInfo.BaseInfo.Name
 		}
+		for name, cr := range rw.CaseRunners {
+			if (stopName == "" || stopName == name) && cr.IsRunning() && cr.State() != CaseStateStopping {
+				go cr.StopRunChannel()
+			}
+		}
+	}
+}
+
+// runningCase returns the running case named caseName, or nil. An empty
+// taskId matches any run of the case.
+func (rw *WorkerRunner) runningCase(caseName, taskId string) *CaseRunner {
+	cr := rw.CaseRunners[caseName]
+	if cr == nil || !cr.IsRunning() || taskId != "" && taskId != cr.Info.TaskId {
+		return nil
 	}
+	return cr
+}
+
+func (rw *WorkerRunner) drainTimeout() time.Duration {
+	if rw.DrainTimeout > 0 {
+		return rw.DrainTimeout
+	}
+	return DefaultDrainTimeout
+}
+
+func (rw *WorkerRunner) sendStepMetrics(metrics []*CallTimeMetric) error {
+	return rw.transport.SendMetrics(context.Background(), metrics)
 }
 
+// PushStatus reports the worker status to the coordinator and applies the
+// heartbeat-loss policy. It holds rw.lock only while it reads and updates the
+// worker state, not during the call.
 func (rw *WorkerRunner) PushStatus() (rwps *RspWorkerPushStatus) {
 	defer func() {
 		if p := recover(); p != nil {
@@ -96,45 +403,144 @@ func (rw *WorkerRunner) PushStatus() (rwps *RspWorkerPushStatus) {
 		}
 	}()
 
-	if rw.RunningCaseRunner != nil {
-		if !rw.RunningCaseRunner.IsRunning {
-			rw.RunningCaseRunner = nil
-			rw.Worker.BaseInfo.Status = "idle"
+	params := func() *WorkerPushStatusParams {
+		rw.lock.Lock()
+		defer rw.lock.Unlock()
+		return rw.statusParams()
+	}()
+	rwps, err := rw.sendStatus(params)
+
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+	if err != nil {
+		fmt.Printf("PushStatus request failed: %v\n", err)
+		rw.failedPushes++
+		rw.handleHeartbeatLoss()
+		return nil
+	}
+	rw.failedPushes = 0
+	rw.lastContact = time.Now()
+	if rw.degraded {
+		rw.degraded = false
+		if len(rw.CaseRunners) > 0 && rw.HeartbeatLoss != nil && rw.HeartbeatLoss.ResumeOnContact {
+			fmt.Println("Coordinator reachable again, restoring full concurrency")
+			for _, cr := range rw.CaseRunners {
+				cr.ClearConcurrencyCap()
+			}
+		}
+	}
+	return rwps
+}
+
+func (rw *WorkerRunner) handleHeartbeatLoss() {
+	policy := rw.HeartbeatLoss
+	if policy == nil || rw.degraded || !rw.hasRunningCase() {
+		return
+	}
+	if rw.lastContact.IsZero() {
+		// RealRun was called without Run; count the silence from now.
+		rw.lastContact = time.Now()
+	}
+	silence := time.Since(rw.lastContact)
+	if !(policy.MaxFailures > 0 && rw.failedPushes >= policy.MaxFailures) &&
+		!(policy.MaxSilence > 0 && silence >= policy.MaxSilence) {
+		return
+	}
+
+	fmt.Printf("Coordinator unreachable for %v (%v failed push_status calls), applying %q heartbeat-loss policy\n",
+		silence.Truncate(time.Second), rw.failedPushes, policy.Action)
+	for _, cr := range rw.CaseRunners {
+		if !cr.IsRunning() {
+			continue
+		}
+		switch policy.Action {
+		case HeartbeatLossReduce:
+			cr.SetConcurrencyCap(policy.reducedConcurrency(cr.Concurrency()))
+		default:
+			go cr.Stop(StopReasonHeartbeatLost)
 		}
 	}
+	rw.degraded = policy.Action == HeartbeatLossReduce
+}
 
-	runningCaseName := ""
-	activeConcurrencyCount := int64(0)
-	if rw.RunningCaseRunner != nil {
-		runningCaseName = rw.RunningCaseRunner.TestCase.Name
-		activeConcurrencyCount = rw.RunningCaseRunner.ActiveConcurrencyCount
+func (rw *WorkerRunner) hasRunningCase() bool {
+	for _, cr := range rw.CaseRunners {
+		if cr.IsRunning() {
+			return true
+		}
 	}
+	return false
+}
 
-	for _, tc := range rw.Worker.BaseInfo.TestCases {
-		if tc.Name == runningCaseName {
-			tc.Status = "running"
-			tc.ActiveConcurrencyCount = activeConcurrencyCount
-		} else {
-			tc.Status = "idle"
-			tc.ActiveConcurrencyCount = 0
+// pushStatus reports the worker status to the coordinator. The caller must
+// hold rw.lock.
+func (rw *WorkerRunner) pushStatus() (*RspWorkerPushStatus, error) {
+	return rw.sendStatus(rw.statusParams())
+}
+
+// statusParams refreshes the case summaries and returns a push_status body
+// that is safe to encode after rw.lock is released. The caller must hold
+// rw.lock.
+func (rw *WorkerRunner) statusParams() *WorkerPushStatusParams {
+	finished := map[string]*CaseRunner{}
+	for name, cr := range rw.CaseRunners {
+		if cr.Done() {
+			finished[name] = cr
+			delete(rw.CaseRunners, name)
 		}
 	}
+	if len(rw.CaseRunners) == 0 && rw.Worker.BaseInfo.Status == "running" {
+		rw.Worker.BaseInfo.Status = "idle"
+	}
 
-	// Prepare request parameters
-	params := &WorkerPushStatusParams{
-		BaseInfo: rw.Worker.BaseInfo,
+	// A case stays in error until it is started again.
+	for _, tc := range rw.Worker.BaseInfo.TestCases {
+		if cr := rw.CaseRunners[tc.Name]; cr != nil {
+			tc.Status = cr.State()
+			tc.ActiveConcurrencyCount = atomic.LoadInt64(&cr.ActiveConcurrencyCount)
+			tc.TargetConcurrency = cr.Concurrency()
+			tc.StepRpsLimits = cr.StepRpsLimits()
+			if snap := cr.CurrentGlobalParams(); snap != nil {
+				tc.GlobalParamsVersion = snap.Version
+			}
+			tc.DroppedIterations = atomic.LoadInt64(&cr.DroppedIterations)
+			tc.TaskId = cr.Info.TaskId
+			tc.StopReason = cr.StopReason()
+		} else if cr := finished[tc.Name]; cr != nil {
+			tc.Status = cr.State()
+			tc.ActiveConcurrencyCount = 0
+			tc.TargetConcurrency = 0
+			tc.StepRpsLimits = nil
+			tc.DroppedIterations = atomic.LoadInt64(&cr.DroppedIterations)
+			tc.TaskId = cr.Info.TaskId
+			tc.StopReason = cr.StopReason()
+		} else if tc.Status != CaseStateError {
+			tc.Status = CaseStateIdle
+			tc.ActiveConcurrencyCount = 0
+			tc.TargetConcurrency = 0
+			tc.StepRpsLimits = nil
+		}
 	}
 
-	// Send HTTP request
-	targetUrl := fmt.Sprintf("%v/worker/push_status", rw.CoordinatorApi)
-	rsp := &RspWorkerPushStatusBody{}
+	offset, rtt, synced := rw.clock.estimate()
+	rw.Worker.BaseInfo.ClockOffsetMs = offset.Milliseconds()
+	rw.Worker.BaseInfo.ClockRttMs = rtt.Milliseconds()
+	rw.Worker.BaseInfo.ClockSynced = synced
 
-	if err := rw.httpClient.PostJSON(targetUrl, params, rsp); err != nil {
-		fmt.Printf("PushStatus HTTP request failed: %v\n", err)
-		return nil
+	return &WorkerPushStatusParams{
+		BaseInfo: rw.Worker.BaseInfo.clone(),
 	}
+}
 
-	return rsp.Data
+// sendStatus sends a push_status body and measures the clock offset from the
+// round trip. It does not need rw.lock.
+func (rw *WorkerRunner) sendStatus(params *WorkerPushStatusParams) (*RspWorkerPushStatus, error) {
+	sent := time.Now()
+	rsp, err := rw.transport.PushStatus(context.Background(), params)
+	if err == nil && rsp != nil && rsp.ServerTime > 0 {
+		rw.clock.add(sent, time.Now(), rsp.ServerTime)
+	}
+	return rsp, err
 }
 
 func (rw *WorkerRunner) AddTestCase(tc *TestCase) {
@@ -148,7 +554,7 @@ func (rw *WorkerRunner) AddTestCase(tc *TestCase) {
 	})
 }
 
-func NewWorkerRunner(workerName, coordinatorApi string) *WorkerRunner {
+func NewWorkerRunner(workerName, coordinatorApi string, opts ...WorkerOption) *WorkerRunner {
 	wk := &Worker{
 		BaseInfo: &WorkerBaseInfo{
 			Name:   workerName,
@@ -157,10 +563,23 @@ func NewWorkerRunner(workerName, coordinatorApi string) *WorkerRunner {
 			Status: "idle",
 		},
 	}
-	return &WorkerRunner{
-		Worker:         wk,
-		CoordinatorApi: coordinatorApi,
-		CaseMaps:       map[string]*TestCase{},
-		httpClient:     NewHTTPClient(5 * time.Second),
+	rw := &WorkerRunner{
+		Worker:            wk,
+		CoordinatorApi:    coordinatorApi,
+		CaseMaps:          map[string]*TestCase{},
+		CaseRunners:       map[string]*CaseRunner{},
+		httpClient:        NewHTTPClient(5 * time.Second),
+		PollBackoff:       DefaultPollBackoff(),
+		MetricsBackoff:    DefaultMetricsBackoff(),
+		MetricsBufferSize: DefaultMetricsBufferSize,
+	}
+	for _, opt := range opts {
+		opt(rw)
+	}
+	if rw.transport == nil {
+		rw.transport = NewHTTPTransport(coordinatorApi, rw.httpClient)
+	} else if rw.httpOptions {
+		fmt.Printf("Worker %v: HTTP client options have no effect with a custom coordinator transport\n", workerName)
 	}
+	return rw
 }
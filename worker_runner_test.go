@@ -0,0 +1,466 @@
+package workerclient
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeCoordinator is a CoordinatorTransport that answers pushes with queued
+// responses and records what the worker sent.
+type fakeCoordinator struct {
+	lock      sync.Mutex
+	responses []*RspWorkerPushStatus // answers to the next pushes, then empty ones
+	pushErr   error                  // fails every push while set
+	statuses  []*WorkerPushStatusParams
+	metrics   [][]*CallTimeMetric
+	closed    int
+}
+
+func (fc *fakeCoordinator) PushStatus(_ context.Context, params *WorkerPushStatusParams) (*RspWorkerPushStatus, error) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	fc.statuses = append(fc.statuses, params)
+	if fc.pushErr != nil {
+		return nil, fc.pushErr
+	}
+	if len(fc.responses) == 0 {
+		return &RspWorkerPushStatus{}, nil
+	}
+	rsp := fc.responses[0]
+	fc.responses = fc.responses[1:]
+	return rsp, nil
+}
+
+func (fc *fakeCoordinator) SendMetrics(_ context.Context, metrics []*CallTimeMetric) error {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	fc.metrics = append(fc.metrics, metrics)
+	return nil
+}
+
+func (fc *fakeCoordinator) ReceiveCommands(ctx context.Context, _ string, _ func() *WorkerBaseInfo, _ func(*RspWorkerPushStatus)) (bool, error) {
+	<-ctx.Done()
+	return false, nil
+}
+
+func (fc *fakeCoordinator) Close() error {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	fc.closed++
+	return nil
+}
+
+// lastStatus returns the worker status of the latest push.
+func (fc *fakeCoordinator) lastStatus() *WorkerBaseInfo {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	if len(fc.statuses) == 0 {
+		return nil
+	}
+	return fc.statuses[len(fc.statuses)-1].BaseInfo
+}
+
+// loopCase returns a case whose single step succeeds at once.
+func loopCase(name string) *TestCase {
+	tc := NewTestCase(name)
+	tc.AddStep(&TestStep{
+		StepName: "s1",
+		ReqPluginFunc: func(map[string]string) IResultV1 {
+			r := AcquireResult("s1")
+			r.Begin()
+			r.ResponseCode = 200
+			r.End()
+			return r
+		},
+		GenReqParamsFunc: func(*CaseParams) map[string]string { return map[string]string{} },
+	})
+	return tc
+}
+
+// startCommand starts name with concurrency VUs on a single worker.
+func startCommand(name, taskId string, concurrency uint64) *RspWorkerPushStatus {
+	return &RspWorkerPushStatus{ShouldRunCase: true, TestCaseInfo: &TestCaseInfo{
+		WorkerTotal: 1,
+		BaseInfo:    &CaseBaseInfo{Name: name, TaskId: taskId, TotalMaxConcurrency: concurrency, WorkerConcurrency: concurrency},
+	}}
+}
+
+// fastPolls makes rw push its status every few milliseconds.
+func fastPolls(rw *WorkerRunner) {
+	rw.PollBackoff = Backoff{Interval: 5 * time.Millisecond, MaxInterval: 5 * time.Millisecond, Multiplier: 1}
+	rw.DrainTimeout = time.Second
+}
+
+func TestRunShutsDownOnCancel(t *testing.T) {
+	fc := &fakeCoordinator{responses: []*RspWorkerPushStatus{startCommand("c", "t1", 2)}}
+	rw := NewWorkerRunner("w", "", WithCoordinatorTransport(fc))
+	fastPolls(rw)
+	spool, err := OpenMetricsSpool(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw.MetricsSpool = spool
+	rw.AddTestCase(loopCase("c"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- rw.Run(ctx) }()
+	var cr *CaseRunner
+	for cr == nil {
+		time.Sleep(time.Millisecond)
+		rw.lock.Lock()
+		cr = rw.CaseRunners["c"]
+		rw.lock.Unlock()
+	}
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return")
+	}
+
+	if !cr.Done() || cr.StopReason() != StopReasonLocalAbort {
+		t.Errorf("case %v, stop reason %v; want it stopped by the shutdown", cr.State(), cr.StopReason())
+	}
+	if s := fc.lastStatus(); s == nil || s.Status != "offline" {
+		t.Errorf("last status %+v, want offline", s)
+	}
+	if fc.closed != 1 {
+		t.Errorf("transport closed %v times, want 1", fc.closed)
+	}
+	if spool.active != nil {
+		t.Error("spool segment still open after Shutdown")
+	}
+}
+
+func TestHandleCommandRejectsDistantStartAt(t *testing.T) {
+	tests := []struct {
+		name    string
+		startAt time.Duration
+		started bool
+	}{
+		{"soon", time.Minute, true},
+		{"within a day", MaxStartDelay - time.Minute, true},
+		{"too far ahead", MaxStartDelay + time.Hour, false},
+	}
+	for _, tt := range tests {
+		rw := NewWorkerRunner("w", "", WithCoordinatorTransport(nopTransport{}))
+		rw.AddTestCase(NewTestCase("c"))
+		rw.lock.Lock()
+		rw.handleCommand(&RspWorkerPushStatus{ShouldRunCase: true, TestCaseInfo: &TestCaseInfo{
+			WorkerTotal: 1,
+			StartAt:     time.Now().Add(tt.startAt).UnixMilli(),
+			BaseInfo:    &CaseBaseInfo{Name: "c", TotalMaxConcurrency: 1, WorkerConcurrency: 1},
+		}})
+		cr := rw.CaseRunners["c"]
+		rw.lock.Unlock()
+		if (cr != nil) != tt.started {
+			t.Errorf("%v: started = %v, want %v", tt.name, cr != nil, tt.started)
+		}
+		if cr != nil {
+			cr.Stop(StopReasonLocalAbort)
+		}
+	}
+}
+
+// startCase starts name on rw the way a push_status answer would.
+func startCase(rw *WorkerRunner, name, taskId string, concurrency uint64) *CaseRunner {
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+	rw.handleCommand(startCommand(name, taskId, concurrency))
+	return rw.CaseRunners[name]
+}
+
+// setPushErr makes the pushes of fc fail with err, or succeed again for nil.
+func (fc *fakeCoordinator) setPushErr(err error) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	fc.pushErr = err
+}
+
+func waitStopped(t *testing.T, cr *CaseRunner) {
+	t.Helper()
+	for begin := time.Now(); !cr.Done(); time.Sleep(time.Millisecond) {
+		if time.Since(begin) > 5*time.Second {
+			t.Fatalf("case still %v", cr.State())
+		}
+	}
+}
+
+func TestHeartbeatLossStopsAfterMaxFailures(t *testing.T) {
+	fc := &fakeCoordinator{}
+	rw := NewWorkerRunner("w", "", WithCoordinatorTransport(fc))
+	rw.HeartbeatLoss = &HeartbeatLossPolicy{MaxFailures: 3, Action: HeartbeatLossStop}
+	rw.AddTestCase(loopCase("c"))
+	cr := startCase(rw, "c", "", 2)
+	defer cr.Stop(StopReasonLocalAbort)
+
+	fc.setPushErr(errors.New("unreachable"))
+	for i := 0; i < 2; i++ {
+		rw.PushStatus()
+	}
+	if !cr.IsRunning() {
+		t.Fatal("case stopped before MaxFailures")
+	}
+	rw.PushStatus()
+	waitStopped(t, cr)
+	if cr.StopReason() != StopReasonHeartbeatLost {
+		t.Errorf("stop reason %v, want %v", cr.StopReason(), StopReasonHeartbeatLost)
+	}
+}
+
+func TestHeartbeatLossStopsAfterMaxSilence(t *testing.T) {
+	fc := &fakeCoordinator{}
+	rw := NewWorkerRunner("w", "", WithCoordinatorTransport(fc))
+	rw.HeartbeatLoss = &HeartbeatLossPolicy{MaxSilence: time.Minute, Action: HeartbeatLossStop}
+	rw.AddTestCase(loopCase("c"))
+	cr := startCase(rw, "c", "", 2)
+	defer cr.Stop(StopReasonLocalAbort)
+
+	rw.PushStatus()
+	fc.setPushErr(errors.New("unreachable"))
+	for i := 0; i < 5; i++ {
+		rw.PushStatus()
+	}
+	if !cr.IsRunning() {
+		t.Fatal("case stopped before MaxSilence")
+	}
+	rw.lock.Lock()
+	rw.lastContact = time.Now().Add(-2 * time.Minute)
+	rw.lock.Unlock()
+	rw.PushStatus()
+	waitStopped(t, cr)
+	if cr.StopReason() != StopReasonHeartbeatLost {
+		t.Errorf("stop reason %v, want %v", cr.StopReason(), StopReasonHeartbeatLost)
+	}
+}
+
+func TestHeartbeatLossReduce(t *testing.T) {
+	tests := []struct {
+		name            string
+		resumeOnContact bool
+		wantCap         int64 // after contact is back
+	}{
+		{"stays reduced", false, 2},
+		{"resumes on contact", true, -1},
+	}
+	for _, tt := range tests {
+		fc := &fakeCoordinator{}
+		rw := NewWorkerRunner("w", "", WithCoordinatorTransport(fc))
+		rw.HeartbeatLoss = &HeartbeatLossPolicy{
+			MaxFailures:               1,
+			Action:                    HeartbeatLossReduce,
+			ReducedConcurrencyPercent: 25,
+			ResumeOnContact:           tt.resumeOnContact,
+		}
+		rw.AddTestCase(loopCase("c"))
+		cr := startCase(rw, "c", "", 8)
+
+		fc.setPushErr(errors.New("unreachable"))
+		rw.PushStatus()
+		if c := atomic.LoadInt64(&cr.concurrencyCap); c != 2 {
+			t.Errorf("%v: cap %v after the loss, want 2", tt.name, c)
+		}
+		// Further failures while degraded leave the cap alone.
+		rw.PushStatus()
+		if c := atomic.LoadInt64(&cr.concurrencyCap); c != 2 {
+			t.Errorf("%v: cap %v after a second failure, want 2", tt.name, c)
+		}
+		fc.setPushErr(nil)
+		rw.PushStatus()
+		if c := atomic.LoadInt64(&cr.concurrencyCap); c != tt.wantCap {
+			t.Errorf("%v: cap %v after contact, want %v", tt.name, c, tt.wantCap)
+		}
+		if !cr.IsRunning() {
+			t.Errorf("%v: reduce stopped the case", tt.name)
+		}
+		cr.Stop(StopReasonLocalAbort)
+	}
+}
+
+func TestReducedConcurrency(t *testing.T) {
+	tests := []struct {
+		percent     uint64
+		concurrency uint64
+		want        uint64
+	}{
+		{0, 10, 5},
+		{30, 10, 3},
+		{150, 10, 10},
+		{10, 3, 1},
+		{50, 0, 0},
+	}
+	for _, tt := range tests {
+		p := &HeartbeatLossPolicy{ReducedConcurrencyPercent: tt.percent}
+		if got := p.reducedConcurrency(tt.concurrency); got != tt.want {
+			t.Errorf("%v%% of %v = %v, want %v", tt.percent, tt.concurrency, got, tt.want)
+		}
+	}
+}
+
+func TestHandleCommandStopsCasesByName(t *testing.T) {
+	rw := NewWorkerRunner("w", "", WithCoordinatorTransport(&fakeCoordinator{}))
+	fastPolls(rw)
+	rw.AddTestCase(loopCase("a"))
+	rw.AddTestCase(loopCase("b"))
+	a := startCase(rw, "a", "t1", 1)
+	b := startCase(rw, "b", "t2", 1)
+	if a == nil || b == nil || a == b {
+		t.Fatalf("cases a %v and b %v, want both running side by side", a, b)
+	}
+	defer b.Stop(StopReasonLocalAbort)
+
+	stop := func(name string) {
+		rsp := &RspWorkerPushStatus{ShouldStopCase: true}
+		if name != "" {
+			rsp.TestCaseInfo = &TestCaseInfo{BaseInfo: &CaseBaseInfo{Name: name}}
+		}
+		rw.lock.Lock()
+		rw.handleCommand(rsp)
+		rw.lock.Unlock()
+	}
+	stop("a")
+	waitStopped(t, a)
+	if a.StopReason() != StopReasonCoordinatorStop || !b.IsRunning() {
+		t.Fatalf("a stopped by %q, b running %v; want only a stopped", a.StopReason(), b.IsRunning())
+	}
+	// A stop without a case name stops the rest.
+	stop("")
+	waitStopped(t, b)
+	if b.StopReason() != StopReasonCoordinatorStop {
+		t.Errorf("b stopped by %q", b.StopReason())
+	}
+}
+
+func TestHandleCommandPropagatesTaskId(t *testing.T) {
+	fc := &fakeCoordinator{}
+	rw := NewWorkerRunner("w", "", WithCoordinatorTransport(fc))
+	fastPolls(rw)
+	seen := make(chan [2]string, 100)
+	tc := NewTestCase("c")
+	tc.AddStep(&TestStep{
+		StepName: "s1",
+		ReqPluginFunc: func(reqParams map[string]string) IResultV1 {
+			r := AcquireResult("s1")
+			r.Begin()
+			r.ResponseCode = 200
+			r.End()
+			return r
+		},
+		GenReqParamsFunc: func(caseParams *CaseParams) map[string]string {
+			return map[string]string{"caseTaskId": caseParams.TaskId}
+		},
+		PreFunc: func(caseParams *CaseParams, reqParams map[string]string) {
+			select {
+			case seen <- [2]string{reqParams["caseTaskId"], reqParams[InnerVarTaskId]}:
+			default:
+			}
+		},
+	})
+	rw.AddTestCase(tc)
+	cr := startCase(rw, "c", "t1", 2)
+
+	if got := <-seen; got != [2]string{"t1", "t1"} {
+		t.Fatalf("CaseParams.TaskId %q and %v %q, want t1", got[0], InnerVarTaskId, got[1])
+	}
+
+	// Commands for another run of the case are ignored.
+	scale := func(taskId string, n uint64) {
+		rw.lock.Lock()
+		defer rw.lock.Unlock()
+		rw.handleCommand(&RspWorkerPushStatus{SetConcurrency: &CaseConcurrencyCommand{CaseName: "c", TaskId: taskId, Concurrency: n}})
+	}
+	scale("t0", 1)
+	if c := cr.Concurrency(); c != 2 {
+		t.Fatalf("a command for task t0 scaled task t1 to %v", c)
+	}
+	scale("t1", 1)
+	if c := cr.Concurrency(); c != 1 {
+		t.Fatalf("concurrency %v after scaling task t1 to 1", c)
+	}
+
+	rw.PushStatus()
+	if s := fc.lastStatus(); len(s.TestCases) != 1 || s.TestCases[0].TaskId != "t1" {
+		t.Errorf("push_status reports cases %+v, want c with task t1", s.TestCases)
+	}
+
+	cr.Stop(StopReasonLocalAbort)
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	sent := 0
+	for _, batch := range fc.metrics {
+		for _, m := range batch {
+			sent++
+			if m.Key.TaskId != "t1" {
+				t.Errorf("metric %v has task %q, want t1", m.Key.MetricName, m.Key.TaskId)
+			}
+		}
+	}
+	if sent == 0 {
+		t.Error("no metrics sent")
+	}
+}
+
+func TestHandleCommandAppliesStepRpsOutsideLock(t *testing.T) {
+	rw := NewWorkerRunner("w", "", WithCoordinatorTransport(&fakeCoordinator{}))
+	fastPolls(rw)
+	var blocking int32
+	release := make(chan struct{})
+	tc := NewTestCase("c")
+	for _, name := range []string{"s1", "s2"} {
+		name := name
+		tc.AddStep(&TestStep{
+			StepName: name,
+			ReqPluginFunc: func(map[string]string) IResultV1 {
+				r := AcquireResult(name)
+				r.Begin()
+				r.End()
+				return r
+			},
+			GenReqParamsFunc: func(*CaseParams) map[string]string { return map[string]string{} },
+			RpsLimitFunc: func(CaseRunnerInfo, map[string]string) uint64 {
+				if atomic.LoadInt32(&blocking) == 1 {
+					<-release
+				}
+				return 7
+			},
+		})
+	}
+	rw.AddTestCase(tc)
+	cr := startCase(rw, "c", "t1", 1)
+	defer cr.Stop(StopReasonLocalAbort)
+	for begin := time.Now(); cr.StepRpsLimits()["s1"] != 7; time.Sleep(time.Millisecond) {
+		if time.Since(begin) > 5*time.Second {
+			t.Fatal("RPS limits not applied at start")
+		}
+	}
+
+	// Refreshing the limits calls the RpsLimitFunc of s2, which blocks.
+	atomic.StoreInt32(&blocking, 1)
+	handled := make(chan struct{})
+	go func() {
+		rw.lock.Lock()
+		rw.handleCommand(&RspWorkerPushStatus{SetStepRps: []*StepRpsCommand{{CaseName: "c", StepName: "s1", Rps: 3}}})
+		rw.lock.Unlock()
+		close(handled)
+	}()
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handleCommand waited for RpsLimitFunc")
+	}
+	close(release)
+	for begin := time.Now(); cr.StepRpsLimits()["s1"] != 3; time.Sleep(time.Millisecond) {
+		if time.Since(begin) > 5*time.Second {
+			t.Fatalf("limits %v, want s1 at 3", cr.StepRpsLimits())
+		}
+	}
+}